@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"strings"
 	"time"
 
@@ -25,8 +26,8 @@ func jsonPP(value string) ([]string, error) {
 }
 
 // BuildIssueBody creates message body of issue by Alert. It should show
-// only basic information of the alert.
-func BuildIssueBody(report ar.Report) string {
+// only basic information of the alert. Mentions are written in CC line.
+func BuildIssueBody(report ar.Report, mentions ...string) string {
 	timeFormat := "2006.01.02 15:04:05"
 	fromTime := time.Unix(int64(report.Alert.Timestamp.Init), 0).Format(timeFormat)
 	toTime := time.Unix(int64(report.Alert.Timestamp.Last), 0).Format(timeFormat)
@@ -40,10 +41,13 @@ func BuildIssueBody(report ar.Report) string {
 	lines := []string{
 		"## Overview",
 		"",
-		fmt.Sprintf("- Detected by %s", report.Alert.Rule),
+		fmt.Sprintf("- Detected by %s", EscapeMarkdown(report.Alert.Rule, MarkdownText)),
 		fmt.Sprintf("- Time: %s", timeRange),
-		"- Attributes:",
 	}
+	if len(mentions) > 0 {
+		lines = append(lines, fmt.Sprintf("- CC: %s", strings.Join(mentions, " ")))
+	}
+	lines = append(lines, "- Attributes:")
 
 	// attributes section excluding json
 	for _, attr := range report.Alert.Attrs {
@@ -51,9 +55,10 @@ func BuildIssueBody(report ar.Report) string {
 			continue
 		}
 
-		base := fmt.Sprintf("  - %s: `%s`", attr.Key, attr.Value)
+		base := fmt.Sprintf("  - %s: %s", EscapeMarkdown(attr.Key, MarkdownText),
+			EscapeMarkdown(attr.Value, MarkdownInlineCode))
 		if len(attr.Context) > 0 {
-			base = fmt.Sprintf("%s (%s)", base, strings.Join(attr.Context, ", "))
+			base = fmt.Sprintf("%s (%s)", base, EscapeMarkdown(strings.Join(attr.Context, ", "), MarkdownText))
 		}
 		lines = append(lines, base)
 	}
@@ -64,21 +69,20 @@ func BuildIssueBody(report ar.Report) string {
 			continue
 		}
 
-		lines = append(lines, []string{
-			"",
-			fmt.Sprintf("### %s", attr.Key),
-			"",
-			"```",
-		}...)
-
 		jsonLines, err := jsonPP(attr.Value)
 		if err != nil {
-			lines = append(lines, attr.Value)
-		} else {
-			lines = append(lines, jsonLines...)
+			jsonLines = strings.Split(attr.Value, "\n")
 		}
+		fence := codeFence(jsonLines)
 
-		lines = append(lines, []string{"```", ""}...)
+		lines = append(lines, []string{
+			"",
+			fmt.Sprintf("### %s", EscapeMarkdown(attr.Key, MarkdownText)),
+			"",
+			fence,
+		}...)
+		lines = append(lines, jsonLines...)
+		lines = append(lines, []string{fence, ""}...)
 	}
 
 	return strings.Join(lines, "\n")
@@ -118,7 +122,7 @@ func buildMalwareSection(pages []ar.ReportMalware) []string {
 		"Type",
 	}
 	for _, vendor := range vendorList {
-		hdr = append(hdr, vendor)
+		hdr = append(hdr, EscapeMarkdown(vendor, MarkdownTableCell))
 	}
 	hdr = append(hdr, "")
 
@@ -139,13 +143,13 @@ func buildMalwareSection(pages []ar.ReportMalware) []string {
 
 	for _, page := range pages {
 		datetime := page.Timestamp.Format("2006-01-02 15:04:05")
-		url := fmt.Sprintf("https://www.virustotal.com/ja/file/%s/analysis/", page.SHA256)
+		vtURL := fmt.Sprintf("https://www.virustotal.com/ja/file/%s/analysis/", url.PathEscape(page.SHA256))
 		row := make([]string, len(hdr))
-		row[1] = fmt.Sprintf("[%s](%s)", datetime, url)
-		row[2] = page.Relation
+		row[1] = fmt.Sprintf("[%s](%s)", EscapeMarkdown(datetime, MarkdownLinkText), vtURL)
+		row[2] = EscapeMarkdown(page.Relation, MarkdownTableCell)
 		for _, scan := range page.Scans {
 			idx := vendors[scan.Vendor]
-			row[3+idx] = scan.Name
+			row[3+idx] = EscapeMarkdown(scan.Name, MarkdownTableCell)
 		}
 		tbody = append(tbody, strings.Join(row, "|"))
 	}
@@ -168,7 +172,8 @@ func buildDomainSection(pages []ar.ReportDomain) []string {
 
 	for _, page := range pages {
 		datetime := page.Timestamp.Format("2006-01-02 15:04:05")
-		body = append(body, fmt.Sprintf("- %s `%s` (%s)", datetime, page.Name, page.Source))
+		body = append(body, fmt.Sprintf("- %s %s (%s)", datetime,
+			EscapeMarkdown(page.Name, MarkdownInlineCode), EscapeMarkdown(page.Source, MarkdownText)))
 	}
 
 	return append(body, "")
@@ -187,9 +192,12 @@ func buildURLSection(pages []ar.ReportURL) []string {
 
 	for _, page := range pages {
 		datetime := page.Timestamp.Format("2006-01-02 15:04:05")
-		line := fmt.Sprintf("- %s `%s` (%s)", datetime, page.URL, page.Source)
-		if page.Reference != "" {
-			line += fmt.Sprintf(" ([Ref](%s))", page.Reference)
+		line := fmt.Sprintf("- %s %s (%s)", datetime,
+			EscapeMarkdown(page.URL, MarkdownInlineCode), EscapeMarkdown(page.Source, MarkdownText))
+		if ref, ok := safeLinkURL(page.Reference); ok {
+			line += fmt.Sprintf(" ([Ref](%s))", ref)
+		} else if page.Reference != "" {
+			line += fmt.Sprintf(" (Ref: %s)", EscapeMarkdown(page.Reference, MarkdownInlineCode))
 		}
 		body = append(body, line)
 	}
@@ -198,14 +206,9 @@ func buildURLSection(pages []ar.ReportURL) []string {
 }
 
 func aggrStrings(values []string) string {
-	vmap := map[string]struct{}{}
-	for _, v := range values {
-		vmap[v] = struct{}{}
-	}
-
 	vlist := []string{}
-	for k := range vmap {
-		vlist = append(vlist, fmt.Sprintf("`%s`", k))
+	for _, v := range uniqueValues(values) {
+		vlist = append(vlist, EscapeMarkdown(v, MarkdownInlineCode))
 	}
 
 	if len(vlist) == 0 {
@@ -215,26 +218,92 @@ func aggrStrings(values []string) string {
 	return strings.Join(vlist, ", ")
 }
 
-func buildOpponentHostSection(pages map[string]ar.ReportOpponentHost) []string {
-	body := []string{}
+// Kinds of report sections.
+const (
+	sectionAlliedHost   = "allied_host"
+	sectionOpponentHost = "opponent_host"
+	sectionSubjectUser  = "subject_user"
+)
 
-	for k, page := range pages {
-		lines := []string{
-			fmt.Sprintf("## Opponent Host: %s", k),
-			"",
-			fmt.Sprintf("- IP address: %s", aggrStrings(page.IPAddr)),
-			fmt.Sprintf("- Country: %s", aggrStrings(page.Country)),
-			fmt.Sprintf("- AS Owner: %s", aggrStrings(page.ASOwner)),
-			"",
-		}
+// reportFact is a named list of values in a report section, e.g. IP
+// addresses of a host.
+type reportFact struct {
+	Name   string
+	Values []string
+}
+
+// reportSection is a host or user section of a published report. Builders of
+// comment body and other formats (e.g. Adaptive Card) render the same
+// sections, then they show the same content.
+type reportSection struct {
+	Kind       string
+	Key        string
+	Title      string
+	Facts      []reportFact
+	Malware    []ar.ReportMalware
+	Domains    []ar.ReportDomain
+	URLs       []ar.ReportURL
+	Activities []ar.ReportActivity
+}
 
-		body = append(body, lines...)
-		body = append(body, buildMalwareSection(page.RelatedMalware)...)
-		body = append(body, buildDomainSection(page.RelatedDomains)...)
-		body = append(body, buildURLSection(page.RelatedURLs)...)
+// reportSections traverses content of the report in order of allied hosts,
+// opponent hosts and subject users. Sections of each kind are sorted by the
+// order.
+func reportSections(report ar.Report, order SectionOrder) []reportSection {
+	var allied, opponent, users []reportSection
+
+	for k, page := range report.Content.AlliedHosts {
+		allied = append(allied, reportSection{
+			Kind:  sectionAlliedHost,
+			Key:   k,
+			Title: fmt.Sprintf("Allied Host: %s", k),
+			Facts: []reportFact{
+				{"UserName", page.UserName},
+				{"Owner", page.Owner},
+				{"OS", page.OS},
+				{"IPAddr", page.IPAddr},
+				{"MACAddr", page.MACAddr},
+				{"HostName", page.HostName},
+				{"Country", page.Country},
+				{"Software", page.Software},
+			},
+			Activities: page.Activities,
+		})
 	}
 
-	return body
+	for k, page := range report.Content.OpponentHosts {
+		opponent = append(opponent, reportSection{
+			Kind:  sectionOpponentHost,
+			Key:   k,
+			Title: fmt.Sprintf("Opponent Host: %s", k),
+			Facts: []reportFact{
+				{"IP address", page.IPAddr},
+				{"Country", page.Country},
+				{"AS Owner", page.ASOwner},
+			},
+			Malware: page.RelatedMalware,
+			Domains: page.RelatedDomains,
+			URLs:    page.RelatedURLs,
+		})
+	}
+
+	for k, page := range report.Content.SubjectUsers {
+		users = append(users, reportSection{
+			Kind:       sectionSubjectUser,
+			Key:        k,
+			Title:      fmt.Sprintf("Subject User: %s", k),
+			Activities: page.Activities,
+		})
+	}
+
+	sections := []reportSection{}
+	for _, kind := range [][]reportSection{allied, opponent, users} {
+		if len(kind) > 0 {
+			sortSections(kind, order.of(kind[0].Kind))
+		}
+		sections = append(sections, kind...)
+	}
+	return sections
 }
 
 func buildActivitySection(usages []ar.ReportActivity) []string {
@@ -251,10 +320,11 @@ func buildActivitySection(usages []ar.ReportActivity) []string {
 	}
 
 	for _, usage := range usages {
-		line := strings.Join([]string{
-			usage.LastSeen.Format("2006-01-02 15:04:05"), usage.RemoteAddr,
-			usage.ServiceName, usage.Principal, usage.Action, usage.Target,
-		}, " | ")
+		cells := []string{usage.RemoteAddr, usage.ServiceName, usage.Principal, usage.Action, usage.Target}
+		for i := range cells {
+			cells[i] = EscapeMarkdown(cells[i], MarkdownTableCell)
+		}
+		line := strings.Join(append([]string{usage.LastSeen.Format("2006-01-02 15:04:05")}, cells...), " | ")
 		body = append(body, line)
 	}
 
@@ -262,54 +332,34 @@ func buildActivitySection(usages []ar.ReportActivity) []string {
 	return body
 }
 
-func buildAlliedHostSection(pages map[string]ar.ReportAlliedHost) []string {
-	body := []string{}
-
-	for k, page := range pages {
-		lines := []string{
-			fmt.Sprintf("## Allied Host: %s", k),
-			"",
-			fmt.Sprintf("- UserName: %s", aggrStrings(page.UserName)),
-			fmt.Sprintf("- Owner: %s", aggrStrings(page.Owner)),
-			fmt.Sprintf("- OS: %s", aggrStrings(page.OS)),
-			fmt.Sprintf("- IPAddr: %s", aggrStrings(page.IPAddr)),
-			fmt.Sprintf("- MACAddr: %s", aggrStrings(page.MACAddr)),
-			fmt.Sprintf("- HostName: %s", aggrStrings(page.HostName)),
-			fmt.Sprintf("- Country: %s", aggrStrings(page.Country)),
-			fmt.Sprintf("- Software: %s", aggrStrings(page.Software)),
-			"",
-		}
-
-		body = append(body, lines...)
-		body = append(body, buildActivitySection(page.Activities)...)
+func buildSection(section reportSection) []string {
+	body := []string{
+		fmt.Sprintf("## %s", EscapeMarkdown(section.Title, MarkdownText)),
+		"",
 	}
 
-	return body
-}
-
-func buildSubjectUserSection(pages map[string]ar.ReportUser) []string {
-	body := []string{}
-
-	for k, page := range pages {
-		lines := []string{
-			fmt.Sprintf("## Subject User: %s", k),
-			"",
+	if len(section.Facts) > 0 {
+		for _, fact := range section.Facts {
+			body = append(body, fmt.Sprintf("- %s: %s", fact.Name, aggrStrings(fact.Values)))
 		}
-
-		body = append(body, lines...)
-		body = append(body, buildActivitySection(page.Activities)...)
+		body = append(body, "")
 	}
 
+	body = append(body, buildMalwareSection(section.Malware)...)
+	body = append(body, buildDomainSection(section.Domains)...)
+	body = append(body, buildURLSection(section.URLs)...)
+	body = append(body, buildActivitySection(section.Activities)...)
+
 	return body
 }
 
-func BuildCommentBody(report ar.Report) string {
+func BuildCommentBody(report ar.Report, order SectionOrder) string {
 	// lines := []string{"# Inspection report"}
 	body := []string{}
 
-	body = append(body, buildAlliedHostSection(report.Content.AlliedHosts)...)
-	body = append(body, buildOpponentHostSection(report.Content.OpponentHosts)...)
-	body = append(body, buildSubjectUserSection(report.Content.SubjectUsers)...)
+	for _, section := range reportSections(report, order) {
+		body = append(body, buildSection(section)...)
+	}
 
 	return strings.Join(body, "\n")
 }
@@ -321,12 +371,26 @@ func BuildPublishedReportHeader(report ar.Report) string {
 	}
 
 	body := []string{
-		fmt.Sprintf("# Report: %s", report.Alert.Title()),
+		fmt.Sprintf("# Report: %s", EscapeMarkdown(report.Alert.Title(), MarkdownText)),
 		"",
-		fmt.Sprintf("- **Severity: %s**", report.Result.Severity),
-		fmt.Sprintf("- Reason: %s", reason),
+		fmt.Sprintf("- **Severity: %s**", EscapeMarkdown(string(report.Result.Severity), MarkdownText)),
+		fmt.Sprintf("- Reason: %s", EscapeMarkdown(reason, MarkdownText)),
 		"",
 	}
 
 	return strings.Join(body, "\n")
 }
+
+// BuildMentionComment creates a comment to CC users and teams that are
+// routed after the issue was created, e.g. by severity decided later.
+func BuildMentionComment(report ar.Report, mentions ...string) string {
+	return fmt.Sprintf("CC: %s (severity **%s**)", strings.Join(mentions, " "),
+		EscapeMarkdown(string(report.Result.Severity), MarkdownText))
+}
+
+// BuildReopenComment creates a comment explaining why a closed issue is
+// reopened.
+func BuildReopenComment(report ar.Report) string {
+	return fmt.Sprintf("Reopened because the report is published again with severity **%s**.",
+		EscapeMarkdown(string(report.Result.Severity), MarkdownText))
+}
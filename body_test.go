@@ -172,7 +172,7 @@ func TestCommentBody(t *testing.T) {
 		},
 	}
 
-	body := main.BuildCommentBody(report)
+	body := main.BuildCommentBody(report, main.SectionOrder{})
 
 	fmt.Println(body)
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+)
+
+// adaptiveCardVersion is the version of Adaptive Card schema supported by
+// Microsoft Teams.
+const adaptiveCardVersion = "1.4"
+
+const cardTimeFormat = "2006-01-02 15:04:05"
+
+// textBlock and factSet take Markdown, then untrusted values in it must be
+// escaped by EscapeCard.
+func textBlock(text string, options map[string]interface{}) map[string]interface{} {
+	block := map[string]interface{}{
+		"type": "TextBlock",
+		"text": text,
+		"wrap": true,
+	}
+	for k, v := range options {
+		block[k] = v
+	}
+	return block
+}
+
+func factSet(facts [][2]string) map[string]interface{} {
+	items := []map[string]string{}
+	for _, f := range facts {
+		items = append(items, map[string]string{"title": f[0], "value": f[1]})
+	}
+	return map[string]interface{}{"type": "FactSet", "facts": items}
+}
+
+// cardStyle returns container style and text color of the severity header.
+func cardStyle(report ar.Report) (style, color string) {
+	switch report.Result.Severity {
+	case ar.SevUrgent:
+		return "attention", "attention"
+	case ar.SevUnclassified:
+		return "warning", "warning"
+	case ar.SevSafe:
+		return "good", "good"
+	default:
+		return "emphasis", "default"
+	}
+}
+
+func buildCardHeader(report ar.Report) map[string]interface{} {
+	style, color := cardStyle(report)
+	severity := string(report.Result.Severity)
+	if severity == "" {
+		severity = "N/A"
+	}
+
+	items := []interface{}{
+		textBlock(EscapeCard(report.Alert.Title()), map[string]interface{}{
+			"size": "large", "weight": "bolder",
+		}),
+		textBlock(fmt.Sprintf("Severity: %s", EscapeCard(severity)), map[string]interface{}{
+			"color": color, "weight": "bolder",
+		}),
+	}
+	if report.Result.Reason != "" {
+		items = append(items, textBlock(fmt.Sprintf("Reason: %s", EscapeCard(report.Result.Reason)), nil))
+	}
+
+	return map[string]interface{}{
+		"type":  "Container",
+		"style": style,
+		"bleed": true,
+		"items": items,
+	}
+}
+
+func buildCardAttributes(report ar.Report) map[string]interface{} {
+	facts := [][2]string{
+		{"Rule", EscapeCard(report.Alert.Rule)},
+	}
+	for _, attr := range report.Alert.Attrs {
+		if attr.Type == "json" {
+			continue
+		}
+		value := attr.Value
+		if len(attr.Context) > 0 {
+			value = fmt.Sprintf("%s (%s)", value, strings.Join(attr.Context, ", "))
+		}
+		facts = append(facts, [2]string{EscapeCard(attr.Key), EscapeCard(value)})
+	}
+	return factSet(facts)
+}
+
+// buildCardSection renders a report section as a title with a toggle and a
+// collapsed container.
+func buildCardSection(section reportSection, id string) []interface{} {
+	items := []interface{}{}
+
+	if len(section.Facts) > 0 {
+		facts := [][2]string{}
+		for _, fact := range section.Facts {
+			values := "N/A"
+			if len(fact.Values) > 0 {
+				values = strings.Join(uniqueValues(fact.Values), ", ")
+			}
+			facts = append(facts, [2]string{fact.Name, EscapeCard(values)})
+		}
+		items = append(items, factSet(facts))
+	}
+
+	addFacts := func(title string, facts [][2]string) {
+		if len(facts) == 0 {
+			return
+		}
+		items = append(items, textBlock(title, map[string]interface{}{"weight": "bolder"}), factSet(facts))
+	}
+
+	var facts [][2]string
+	for _, mw := range section.Malware {
+		names := []string{}
+		for _, scan := range mw.Scans {
+			names = append(names, fmt.Sprintf("%s: %s", scan.Vendor, scan.Name))
+		}
+		value := fmt.Sprintf("%s %s (%s)", mw.Timestamp.Format(cardTimeFormat), mw.Relation, strings.Join(names, ", "))
+		facts = append(facts, [2]string{EscapeCard(mw.SHA256), EscapeCard(value)})
+	}
+	addFacts("Related Malware", facts)
+
+	facts = nil
+	for _, d := range section.Domains {
+		value := fmt.Sprintf("%s (%s)", d.Timestamp.Format(cardTimeFormat), d.Source)
+		facts = append(facts, [2]string{EscapeCard(d.Name), EscapeCard(value)})
+	}
+	addFacts("Related Domain", facts)
+
+	facts = nil
+	for _, u := range section.URLs {
+		value := EscapeCard(fmt.Sprintf("%s (%s)", u.Timestamp.Format(cardTimeFormat), u.Source))
+		if ref, ok := safeLinkURL(u.Reference); ok {
+			value += fmt.Sprintf(" [Ref](%s)", ref)
+		} else if u.Reference != "" {
+			value += fmt.Sprintf(" (Ref: %s)", EscapeCard(u.Reference))
+		}
+		facts = append(facts, [2]string{EscapeCard(u.URL), value})
+	}
+	addFacts("Related URLs", facts)
+
+	facts = nil
+	for _, a := range section.Activities {
+		facts = append(facts, [2]string{
+			a.LastSeen.Format(cardTimeFormat),
+			EscapeCard(strings.Join([]string{a.RemoteAddr, a.ServiceName, a.Principal, a.Action, a.Target}, " / ")),
+		})
+	}
+	addFacts("Service Activities", facts)
+
+	return []interface{}{
+		map[string]interface{}{
+			"type": "ActionSet",
+			"actions": []interface{}{
+				map[string]interface{}{
+					"type":           "Action.ToggleVisibility",
+					"title":          section.Title,
+					"targetElements": []string{id},
+				},
+			},
+		},
+		map[string]interface{}{
+			"type":      "Container",
+			"id":        id,
+			"isVisible": false,
+			"items":     items,
+		},
+	}
+}
+
+// BuildAdaptiveCard creates an Adaptive Card of the report. Severity is a
+// colored header, alert attributes are a fact set and host and user sections
+// of a published report are collapsible containers sorted by the order.
+func BuildAdaptiveCard(report ar.Report, issueURL string, order SectionOrder) map[string]interface{} {
+	body := []interface{}{
+		buildCardHeader(report),
+		buildCardAttributes(report),
+	}
+
+	for i, section := range reportSections(report, order) {
+		id := fmt.Sprintf("section-%d", i)
+		body = append(body, buildCardSection(section, id)...)
+	}
+
+	card := map[string]interface{}{
+		"type":    "AdaptiveCard",
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"version": adaptiveCardVersion,
+		"body":    body,
+	}
+	if u, ok := safeLinkURL(issueURL); ok {
+		card["actions"] = []interface{}{
+			map[string]interface{}{
+				"type":  "Action.OpenUrl",
+				"title": "Open issue",
+				"url":   u,
+			},
+		}
+	}
+	return card
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// MarkdownMode is a context in Markdown where an untrusted value is written.
+type MarkdownMode int
+
+const (
+	// MarkdownText is plain text in a heading, list item or paragraph.
+	MarkdownText MarkdownMode = iota
+	// MarkdownInlineCode is a code span. The result has backticks around it.
+	MarkdownInlineCode
+	// MarkdownTableCell is text in a cell of a pipe table.
+	MarkdownTableCell
+	// MarkdownLinkText is text between brackets of a link.
+	MarkdownLinkText
+)
+
+const zeroWidthSpace = "\u200b"
+
+var (
+	mdTextSpecial = strings.NewReplacer(
+		`\`, `\\`, "`", "\\`", "*", `\*`, "_", `\_`, "~", `\~`,
+		"[", `\[`, "]", `\]`, "<", `\<`, ">", `\>`, "&", `\&`,
+	)
+	mdLineBreak = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+	// A mention (@user) or a reference (#123, GH-123) is linked by GitHub
+	// even in escaped text, then a zero width space breaks it.
+	mdMention    = regexp.MustCompile(`(^|[^0-9A-Za-z_])@([0-9A-Za-z])`)
+	mdIssueRef   = regexp.MustCompile(`#([0-9])`)
+	mdGHIssueRef = regexp.MustCompile(`(?i)\b(GH)-([0-9])`)
+	// GitLab also links a merge request (!123), a milestone (%123), a snippet
+	// ($123), a label (~bug) and an epic (&123).
+	mdGitLabRef = regexp.MustCompile(`([!%$~&])([0-9A-Za-z"])`)
+
+	// Slack parses links, mentions (<@U123>, <!channel>) and entities in
+	// angle brackets and ampersands only.
+	slackSpecial = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+	// Adaptive Card in Teams renders bold (**), italic (_), lists and links
+	// only, and has no backslash escape. A zero width space around a marker
+	// keeps it from pairing with another one.
+	cardSpecial = strings.NewReplacer(
+		"*", zeroWidthSpace+"*"+zeroWidthSpace, "_", zeroWidthSpace+"_"+zeroWidthSpace,
+		"]", "]"+zeroWidthSpace,
+	)
+	cardListItem = regexp.MustCompile(`^\s*([-+*]|[0-9]+\.)\s`)
+)
+
+// EscapeMarkdown encodes an untrusted value for the mode. The value can not
+// change structure of the document (e.g. break a table or a code span), ping
+// users, link issues or inject HTML. It's for Markdown of GitHub, GitLab and
+// mail. Jira wiki markup is escaped by MarkdownToJiraWiki, Slack mrkdwn by
+// EscapeSlack and Adaptive Card text by EscapeCard.
+func EscapeMarkdown(s string, mode MarkdownMode) string {
+	s = mdLineBreak.Replace(s)
+
+	switch mode {
+	case MarkdownInlineCode:
+		return codeSpan(s)
+	case MarkdownTableCell:
+		return strings.Replace(escapeText(s), "|", `\|`, -1)
+	case MarkdownLinkText:
+		if s == "" {
+			return "link"
+		}
+		return escapeText(s)
+	default:
+		return escapeText(s)
+	}
+}
+
+func escapeText(s string) string {
+	s = mdTextSpecial.Replace(s)
+	s = mdMention.ReplaceAllString(s, "$1@"+zeroWidthSpace+"$2")
+	s = mdIssueRef.ReplaceAllString(s, "#"+zeroWidthSpace+"$1")
+	s = mdGHIssueRef.ReplaceAllString(s, "$1"+zeroWidthSpace+"-$2")
+	return mdGitLabRef.ReplaceAllString(s, "$1"+zeroWidthSpace+"$2")
+}
+
+// EscapeSlack encodes an untrusted value for text of a Slack message. The
+// value can not make links or mention users and channels.
+func EscapeSlack(s string) string {
+	return slackSpecial.Replace(s)
+}
+
+// EscapeCard encodes an untrusted value for text of TextBlock and FactSet in
+// an Adaptive Card. The value shows as it is and can not make bold, italic,
+// a list or a link.
+func EscapeCard(s string) string {
+	s = mdLineBreak.Replace(s)
+	if cardListItem.MatchString(s) {
+		s = zeroWidthSpace + s
+	}
+	return cardSpecial.Replace(s)
+}
+
+// longestRun returns length of the longest run of c in s.
+func longestRun(s string, c rune) int {
+	longest, n := 0, 0
+	for _, r := range s {
+		if r == c {
+			n++
+			if n > longest {
+				longest = n
+			}
+		} else {
+			n = 0
+		}
+	}
+	return longest
+}
+
+// codeSpan wraps s with backticks more than any run of backticks in s. Text
+// in a code span is not interpreted as Markdown or mention.
+func codeSpan(s string) string {
+	if s == "" {
+		return "` `"
+	}
+
+	fence := strings.Repeat("`", longestRun(s, '`')+1)
+	// One space at both ends is stripped, then it keeps a backtick at an end
+	// apart from the fence.
+	if strings.HasPrefix(s, "`") || strings.HasSuffix(s, "`") ||
+		(strings.HasPrefix(s, " ") && strings.HasSuffix(s, " ") && strings.Trim(s, " ") != "") {
+		s = " " + s + " "
+	}
+	return fence + s + fence
+}
+
+// codeFence returns a fence of a code block that is not closed by the lines.
+func codeFence(lines []string) string {
+	n := 2
+	for _, line := range lines {
+		if run := longestRun(line, '`'); run > n {
+			n = run
+		}
+	}
+	return strings.Repeat("`", n+1)
+}
+
+// safeLinkURL returns the URL encoded to be a link destination. ok is false
+// if it's not a http or https URL.
+func safeLinkURL(raw string) (string, bool) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", false
+	}
+	s := strings.NewReplacer(
+		"(", "%28", ")", "%29", " ", "%20", "<", "%3C", ">", "%3E",
+		"|", "%7C", `"`, "%22", "`", "%60", `\`, "%5C",
+	).Replace(u.String())
+	return s, true
+}
@@ -0,0 +1,254 @@
+package main_test
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	main "github.com/m-mizutani/GithubEmitter"
+)
+
+const zeroWidthSpace = "\u200b"
+
+var (
+	autoMention  = regexp.MustCompile(`(^|[^0-9A-Za-z_])@[0-9A-Za-z]`)
+	autoIssueRef = regexp.MustCompile(`#[0-9]`)
+)
+
+// flatten is what EscapeMarkdown does to line breaks.
+func flatten(s string) string {
+	return strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(s)
+}
+
+func TestEscapeMarkdown(t *testing.T) {
+	assert.Equal(t, "`10.0.0.1`", main.EscapeMarkdown("10.0.0.1", main.MarkdownInlineCode))
+	assert.Equal(t, "``a`b``", main.EscapeMarkdown("a`b", main.MarkdownInlineCode))
+	assert.Equal(t, "`` `a ``", main.EscapeMarkdown("`a", main.MarkdownInlineCode))
+	assert.Equal(t, "` `", main.EscapeMarkdown("", main.MarkdownInlineCode))
+	assert.Equal(t, "`a b`", main.EscapeMarkdown("a\nb", main.MarkdownInlineCode))
+
+	assert.Equal(t, `a\|b \<img\> \*x\*`, main.EscapeMarkdown("a|b <img> *x*", main.MarkdownTableCell))
+	assert.Equal(t, "@"+zeroWidthSpace+"admin and #"+zeroWidthSpace+"123 and GH"+zeroWidthSpace+"-4",
+		main.EscapeMarkdown("@admin and #123 and GH-4", main.MarkdownText))
+	assert.Equal(t, "user@example.com", main.EscapeMarkdown("user@example.com", main.MarkdownText))
+	assert.Equal(t, "!"+zeroWidthSpace+"12 %"+zeroWidthSpace+"3 $"+zeroWidthSpace+"4 \\~"+zeroWidthSpace+"bug \\&"+zeroWidthSpace+"5",
+		main.EscapeMarkdown("!12 %3 $4 ~bug &5", main.MarkdownText))
+	assert.Equal(t, `\[x\](https://example.com)`, main.EscapeMarkdown("[x](https://example.com)", main.MarkdownLinkText))
+	assert.Equal(t, "link", main.EscapeMarkdown("", main.MarkdownLinkText))
+}
+
+func TestEscapeSlack(t *testing.T) {
+	assert.Equal(t, "a &amp;lt; &lt;!here&gt; *b*", main.EscapeSlack("a &lt; <!here> *b*"))
+	assert.Equal(t, "", main.EscapeSlack(""))
+}
+
+func TestEscapeCard(t *testing.T) {
+	z := zeroWidthSpace
+	assert.Equal(t, z+"*"+z+z+"*"+z+"b"+z+"*"+z+z+"*"+z, main.EscapeCard("**b**"))
+	assert.Equal(t, "a"+z+"_"+z+"b", main.EscapeCard("a_b"))
+	assert.Equal(t, "[x]"+z+"(https://example.com)", main.EscapeCard("[x](https://example.com)"))
+	assert.Equal(t, z+"- a", main.EscapeCard("- a"))
+	assert.Equal(t, z+"1. a", main.EscapeCard("1. a"))
+	assert.Equal(t, `a\b <c> & @admin #1`, main.EscapeCard(`a\b <c> & @admin #1`))
+}
+
+func TestBodyEscape(t *testing.T) {
+	report := genDummyReport()
+	report.Alert.Rule = "rule <script>alert(1)</script>"
+	report.Alert.Attrs = append(report.Alert.Attrs, ar.Attribute{
+		Type:    "domain",
+		Key:     "@admin",
+		Value:   "evil`.com",
+		Context: []string{"#1"},
+	}, ar.Attribute{
+		Type:  "json",
+		Key:   "raw",
+		Value: "not json\n```\n# heading",
+	})
+	body := main.BuildIssueBody(report)
+	assert.Contains(t, body, `- Detected by rule \<script\>alert(1)\</script\>`)
+	assert.Contains(t, body, "  - @"+zeroWidthSpace+"admin: ``evil`.com`` (#"+zeroWidthSpace+"1)")
+	assert.Contains(t, body, "````\nnot json\n```\n# heading\n````")
+
+	page := report.Content.OpponentHosts["10.0.0.1"]
+	page.RelatedMalware[0].Relation = "a|b"
+	page.RelatedMalware[0].Scans[0].Name = "Win32|x"
+	page.RelatedURLs = []ar.ReportURL{
+		{URL: "http://evil.example.com/`x`", Source: "@bot", Reference: "javascript:alert(1)"},
+		{URL: "http://ok.example.com", Source: "vt", Reference: "https://ref.example.com/a b(c)"},
+	}
+	report.Content.OpponentHosts["10.0.0.1"] = page
+
+	body = main.BuildCommentBody(report, main.SectionOrder{})
+	assert.Contains(t, body, `|a\|b|Win32\|x|`)
+	assert.Contains(t, body, "`` http://evil.example.com/`x` `` (@"+zeroWidthSpace+"bot) (Ref: `javascript:alert(1)`)")
+	assert.Contains(t, body, "([Ref](https://ref.example.com/a%20b%28c%29))")
+
+	rendered := main.MarkdownToHTML(body)
+	assert.NotContains(t, rendered, "javascript:alert(1)\"")
+	assert.Contains(t, rendered, "<td>a|b</td><td>Win32|x</td>")
+	assert.Contains(t, rendered, `<a href="https://ref.example.com/a%20b%28c%29">Ref</a>`)
+}
+
+func FuzzEscapeInlineCode(f *testing.F) {
+	for _, seed := range []string{"", "a", "`", "a``b", " ` ", "  ", "x\ny", "<b>", "[a](b)", `\`} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		code := main.EscapeMarkdown(s, main.MarkdownInlineCode)
+		require.NotContains(t, code, "\n")
+
+		// The fence at both ends has the same length, and no run in the
+		// content is long enough to close it.
+		n := len(code) - len(strings.TrimLeft(code, "`"))
+		require.True(t, n > 0, code)
+		require.True(t, len(code) > 2*n, code)
+		require.Equal(t, n, len(code)-len(strings.TrimRight(code, "`")), code)
+		content := code[n : len(code)-n]
+		require.True(t, longestRun(content, '`') < n, code)
+
+		if strings.HasPrefix(content, " ") && strings.HasSuffix(content, " ") && strings.Trim(content, " ") != "" {
+			content = content[1 : len(content)-1]
+		}
+		expected := flatten(s)
+		if expected == "" {
+			expected = " "
+		}
+		require.Equal(t, expected, content)
+	})
+}
+
+func FuzzEscapeTableCell(f *testing.F) {
+	for _, seed := range []string{"", "a|b", `a\|b`, "|", `\`, "`|`", "<td>", "x\n|y|", "**b**", "[a](http://b)"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		cell := main.EscapeMarkdown(s, main.MarkdownTableCell)
+		requirePlainText(t, s, cell)
+		require.False(t, hasUnescaped(cell, '|'), cell)
+	})
+}
+
+func FuzzEscapeText(f *testing.F) {
+	for _, seed := range []string{"", "@admin", "#1", "GH-1", "!1", "%1", "$1", "~bug", "&1", "a@b.com", "<script>", "**b**", "_i_", "~s~", "&amp;", `\*`} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		requirePlainText(t, s, main.EscapeMarkdown(s, main.MarkdownText))
+	})
+}
+
+func FuzzEscapeLinkText(f *testing.F) {
+	for _, seed := range []string{"", "a", "]", "[x](y)", "`]`", `\`, "a](http://evil)"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		text := main.EscapeMarkdown(s, main.MarkdownLinkText)
+		if s == "" {
+			require.Equal(t, "link", text)
+			return
+		}
+		requirePlainText(t, s, text)
+	})
+}
+
+func FuzzEscapeCard(f *testing.F) {
+	for _, seed := range []string{"", "**b**", "_i_", "a_b", "[x](y)", "- a", "  * a", "10. a", `\*`, "x\n- y"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		text := main.EscapeCard(s)
+		require.NotContains(t, text, "\n")
+		require.False(t, cardBold.MatchString(text), text)
+		require.False(t, cardBareMarker.MatchString(text), text)
+		require.False(t, cardLink.MatchString(text), text)
+		require.False(t, cardList.MatchString(text), text)
+
+		// Teams has no backslash escape, then text is shown as it is.
+		expected := strings.Replace(flatten(s), zeroWidthSpace, "", -1)
+		require.Equal(t, expected, strings.Replace(text, zeroWidthSpace, "", -1))
+	})
+}
+
+var (
+	// Markup of TextBlock in Teams: bold, italic, a link and a list.
+	cardBold       = regexp.MustCompile(`\*\*`)
+	cardBareMarker = regexp.MustCompile(`(^|[^\x{200b}])[*_]|[*_]([^\x{200b}]|$)`)
+	cardLink       = regexp.MustCompile(`\]\(`)
+	cardList       = regexp.MustCompile(`^\s*([-+*]|[0-9]+\.)\s`)
+
+	autoGHIssueRef = regexp.MustCompile(`(?i)\bGH-[0-9]`)
+	autoGitLabRef  = regexp.MustCompile(`[!%$~&][0-9A-Za-z"]`)
+)
+
+// requirePlainText checks text escaped from s has no Markdown syntax, HTML,
+// mention or reference, and shows s as it is.
+func requirePlainText(t *testing.T, s, text string) {
+	require.NotContains(t, text, "\n")
+	for _, c := range "\\`*_~[]<>&" {
+		require.False(t, hasUnescaped(text, byte(c)), text)
+	}
+
+	shown := unescapeMarkdown(text)
+	require.False(t, autoMention.MatchString(shown), text)
+	require.False(t, autoIssueRef.MatchString(shown), text)
+	require.False(t, autoGHIssueRef.MatchString(shown), text)
+	require.False(t, autoGitLabRef.MatchString(shown), text)
+
+	expected := strings.Replace(flatten(s), zeroWidthSpace, "", -1)
+	require.Equal(t, expected, strings.Replace(shown, zeroWidthSpace, "", -1))
+}
+
+// hasUnescaped returns true if text has c without a backslash before it.
+func hasUnescaped(text string, c byte) bool {
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+1 < len(text) && strings.IndexByte(mdPunct, text[i+1]) >= 0 {
+			i++
+			continue
+		}
+		if text[i] == c {
+			return true
+		}
+	}
+	return false
+}
+
+// mdPunct is ASCII punctuation that can be escaped by a backslash.
+const mdPunct = "!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~"
+
+// unescapeMarkdown returns text shown for the escaped text.
+func unescapeMarkdown(text string) string {
+	b := []byte{}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+1 < len(text) && strings.IndexByte(mdPunct, text[i+1]) >= 0 {
+			i++
+		}
+		b = append(b, text[i])
+	}
+	return string(b)
+}
+
+// longestRun returns length of the longest run of c in s.
+func longestRun(s string, c rune) int {
+	longest, n := 0, 0
+	for _, r := range s {
+		if r == c {
+			n++
+			if n > longest {
+				longest = n
+			}
+		} else {
+			n = 0
+		}
+	}
+	return longest
+}
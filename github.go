@@ -2,83 +2,554 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/cenkalti/backoff"
+	ar "github.com/m-mizutani/AlertResponder/lib"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 )
 
 type GitHub struct {
 	endpoint   string
 	repository string
 	token      string
+
+	client       *http.Client
+	maxRetryTime time.Duration
+
+	maxRateLimitWait time.Duration
+	rateLimitMutex   sync.Mutex
+	rateLimits       map[string]GitHubRateLimit
+}
+
+// GitHubRateLimit is a quota of GitHub API reported by X-RateLimit-* headers.
+type GitHubRateLimit struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+// GitHubRateLimitError is returned when a request is rejected by primary or
+// secondary rate limit and waiting for it exceeds the budget.
+type GitHubRateLimitError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (x *GitHubRateLimitError) Error() string {
+	return fmt.Sprintf("GitHub rate limit exceeded, code: %d, retry after: %s",
+		x.StatusCode, x.RetryAfter)
+}
+
+// GitHubAPIError is an error response of GitHub API.
+type GitHubAPIError struct {
+	StatusCode       int                     `json:"-"`
+	RequestID        string                  `json:"-"`
+	Message          string                  `json:"message"`
+	DocumentationURL string                  `json:"documentation_url"`
+	Errors           []GitHubValidationError `json:"errors"`
+}
+
+// GitHubValidationError is a detail of 422 Unprocessable Entity error.
+type GitHubValidationError struct {
+	Resource string `json:"resource"`
+	Field    string `json:"field"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+}
+
+// UnmarshalJSON accepts also a plain string that is returned by some APIs
+// as an item of "errors".
+func (x *GitHubValidationError) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &x.Message)
+	}
+
+	type alias GitHubValidationError
+	return json.Unmarshal(data, (*alias)(x))
+}
+
+// newGitHubAPIError builds GitHubAPIError from an unexpected response. The
+// response body is consumed.
+func newGitHubAPIError(resp *http.Response) *GitHubAPIError {
+	apiErr := &GitHubAPIError{
+		StatusCode: resp.StatusCode,
+		RequestID:  resp.Header.Get("X-GitHub-Request-Id"),
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || json.Unmarshal(body, apiErr) != nil {
+		// Not JSON, e.g. an error page of a proxy.
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+
+	return apiErr
+}
+
+func (x *GitHubAPIError) Error() string {
+	msg := fmt.Sprintf("GitHub API error, code: %d, message: %s", x.StatusCode, x.Message)
+
+	details := []string{}
+	for _, e := range x.Errors {
+		if e.Field != "" {
+			details = append(details, fmt.Sprintf("%s.%s: %s %s", e.Resource, e.Field, e.Code, e.Message))
+		} else {
+			details = append(details, e.Message)
+		}
+	}
+	if len(details) > 0 {
+		msg += fmt.Sprintf(", errors: [%s]", strings.Join(details, "; "))
+	}
+
+	if x.DocumentationURL != "" {
+		msg += ", doc: " + x.DocumentationURL
+	}
+	if x.RequestID != "" {
+		msg += ", request ID: " + x.RequestID
+	}
+	return msg
+}
+
+func toGitHubAPIError(err error) (*GitHubAPIError, bool) {
+	apiErr, ok := errors.Cause(err).(*GitHubAPIError)
+	return apiErr, ok
+}
+
+// IsNotFound returns true if the error means that the resource does not exist
+// or is deleted (e.g. a deleted or transferred issue).
+func IsNotFound(err error) bool {
+	apiErr, ok := toGitHubAPIError(err)
+	return ok && (apiErr.StatusCode == http.StatusNotFound || apiErr.StatusCode == http.StatusGone)
+}
+
+// IsRateLimited returns true if the error is caused by rate limit of GitHub.
+func IsRateLimited(err error) bool {
+	if _, ok := errors.Cause(err).(*GitHubRateLimitError); ok {
+		return true
+	}
+
+	apiErr, ok := toGitHubAPIError(err)
+	return ok && (apiErr.StatusCode == http.StatusTooManyRequests ||
+		(apiErr.StatusCode == http.StatusForbidden &&
+			strings.Contains(strings.ToLower(apiErr.Message), "rate limit")))
+}
+
+// IsValidation returns true if the request is rejected as invalid parameter.
+func IsValidation(err error) bool {
+	apiErr, ok := toGitHubAPIError(err)
+	return ok && apiErr.StatusCode == http.StatusUnprocessableEntity
 }
 
 type GitHubIssue struct {
-	HtmlURL string `json:"html_url"`
-	ApiURL  string `json:"url"`
-	Title   string `json:"title"`
-	Content string `json:"body"`
-	github  *GitHub
+	HtmlURL   string        `json:"html_url"`
+	ApiURL    string        `json:"url"`
+	Title     string        `json:"title"`
+	Content   string        `json:"body"`
+	State     string        `json:"state"`
+	Labels    []GitHubLabel `json:"labels"`
+	Assignees []GitHubUser  `json:"assignees"`
+	github    *GitHub
+}
+
+type GitHubLabel struct {
+	Name string `json:"name"`
+}
+
+// GitHubIssueRequest is parameters to create a new issue.
+type GitHubIssueRequest struct {
+	Title     string   `json:"title"`
+	Body      string   `json:"body"`
+	Labels    []string `json:"labels,omitempty"`
+	Assignees []string `json:"assignees,omitempty"`
 }
 
 type GitHubIssueComment struct {
-	HtmlURL  string `json:"html_url"`
-	ApiURL   string `json:"url"`
-	IssueURL string `json:"issue_url"`
-	Body     string `json:"body"`
+	ID        int64      `json:"id"`
+	HtmlURL   string     `json:"html_url"`
+	ApiURL    string     `json:"url"`
+	IssueURL  string     `json:"issue_url"`
+	Body      string     `json:"body"`
+	User      GitHubUser `json:"user"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+type GitHubUser struct {
+	ID    int64  `json:"id"`
+	Login string `json:"login"`
+}
+
+const (
+	defaultGitHubTimeout          = 30 * time.Second
+	defaultGitHubMaxRetryTime     = 60 * time.Second
+	defaultGitHubMaxRateLimitWait = 60 * time.Second
+
+	// GitHub recommends to wait at least one minute for secondary rate limit
+	// without Retry-After header.
+	secondaryRateLimitWait = 60 * time.Second
+)
+
+// GitHubOption is an optional setting of GitHub accessor.
+type GitHubOption func(x *GitHub)
+
+// WithHTTPClient replaces HTTP client to access GitHub API.
+func WithHTTPClient(client *http.Client) GitHubOption {
+	return func(x *GitHub) {
+		x.client = client
+	}
+}
+
+// WithTransport replaces RoundTripper of the default HTTP client.
+func WithTransport(transport http.RoundTripper) GitHubOption {
+	return func(x *GitHub) {
+		x.client = &http.Client{
+			Timeout:   defaultGitHubTimeout,
+			Transport: transport,
+		}
+	}
+}
+
+// WithMaxRetryTime sets max duration to retry a request. Zero disables retry.
+func WithMaxRetryTime(d time.Duration) GitHubOption {
+	return func(x *GitHub) {
+		x.maxRetryTime = d
+	}
+}
+
+// WithMaxRateLimitWait sets max duration to wait for rate limit in a request.
+// A request fails immediately with GitHubRateLimitError if it needs to wait
+// longer. Zero means fail fast.
+func WithMaxRateLimitWait(d time.Duration) GitHubOption {
+	return func(x *GitHub) {
+		x.maxRateLimitWait = d
+	}
 }
 
 //
 // NewGitHub returns a GitHub accessor. Currently it's based on AWS KMS decryption for
 // secret value (GitHub token). It's planned to be replaced with AWS SecretManager
 //
-func NewGitHub(endpoint, repository, token string) (*GitHub, error) {
+func NewGitHub(endpoint, repository, token string, options ...GitHubOption) (*GitHub, error) {
 	g := GitHub{
-		endpoint:   endpoint,
-		repository: repository,
-		token:      token,
+		endpoint:     endpoint,
+		repository:   repository,
+		token:        token,
+		client:       &http.Client{Timeout: defaultGitHubTimeout},
+		maxRetryTime: defaultGitHubMaxRetryTime,
+
+		maxRateLimitWait: defaultGitHubMaxRateLimitWait,
+		rateLimits:       map[string]GitHubRateLimit{},
+	}
+
+	for _, opt := range options {
+		opt(&g)
 	}
 
 	return &g, nil
 }
 
 //
-// NewIssue creates an new issue on github with title and issue's body
+// RateLimit returns the latest quota of the resource ("core" or "search")
+// observed in responses. It returns false if no response has been received.
 //
-func (x *GitHub) NewIssue(title, content string) (*GitHubIssue, error) {
-	issueReq := struct {
-		TItle string `json:"title"`
-		Body  string `json:"body"`
-	}{
-		TItle: title,
-		Body:  content,
+func (x *GitHub) RateLimit(resource string) (GitHubRateLimit, bool) {
+	x.rateLimitMutex.Lock()
+	defer x.rateLimitMutex.Unlock()
+
+	limit, ok := x.rateLimits[resource]
+	return limit, ok
+}
+
+// rateLimitResource returns a resource name of rate limit for the URL.
+// Search API has a quota separated from other APIs.
+func rateLimitResource(apiURL string) string {
+	if strings.Contains(apiURL, "/search/") {
+		return "search"
 	}
+	return "core"
+}
 
-	binData, err := json.Marshal(issueReq)
+func (x *GitHub) updateRateLimit(resource string, resp *http.Response) {
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
 	if err != nil {
-		return nil, errors.Wrap(err, "Fail to create JSON message")
+		return // GHE disables rate limit by default and returns no header.
 	}
 
-	client := &http.Client{}
-	url := fmt.Sprintf("%s/repos/%s/issues", x.endpoint, x.repository)
+	limit := GitHubRateLimit{Remaining: remaining}
+	limit.Limit, _ = strconv.Atoi(resp.Header.Get("X-RateLimit-Limit"))
+	if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		limit.Reset = time.Unix(reset, 0)
+	}
+
+	x.rateLimitMutex.Lock()
+	x.rateLimits[resource] = limit
+	x.rateLimitMutex.Unlock()
+}
+
+// rateLimitWait returns duration to wait before the next request if the
+// response is rejected by primary or secondary rate limit.
+func rateLimitWait(resp *http.Response) (time.Duration, bool) {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+
+	if sec, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		return time.Duration(sec) * time.Second, true
+	}
+
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+		if err == nil {
+			wait := time.Until(time.Unix(reset, 0))
+			if wait < time.Second {
+				wait = time.Second
+			}
+			return wait, true
+		}
+		return secondaryRateLimitWait, true
+	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewReader(binData))
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return secondaryRateLimitWait, true
+	}
+
+	// 403 is also returned for permission error. Secondary rate limit can be
+	// distinguished only by message in the body.
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
 	if err != nil {
-		return nil, errors.Wrap(err, "Fail to build a request to create github issue")
+		return 0, false
+	}
+
+	msg := strings.ToLower(string(body))
+	if strings.Contains(msg, "secondary rate limit") || strings.Contains(msg, "abuse") {
+		return secondaryRateLimitWait, true
+	}
+	return 0, false
+}
+
+//
+// request sends a request to GitHub API with the token. data is sent as
+// JSON body if it's not nil. If the request is rejected by rate limit, it
+// waits and sends the request again within maxRateLimitWait in total.
+// Otherwise it returns GitHubRateLimitError. If the remaining quota is
+// already exhausted, it waits (or fails) before sending the request. It
+// also fails without waiting if the wait exceeds deadline of ctx.
+//
+func (x *GitHub) request(ctx context.Context, method, apiURL string, data interface{}) (*http.Response, error) {
+	var body []byte
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return nil, errors.Wrap(err, "Fail to create JSON message")
+		}
+		body = raw
+	}
+
+	resource := rateLimitResource(apiURL)
+	var waited time.Duration
+
+	if limit, ok := x.RateLimit(resource); ok && limit.Remaining == 0 {
+		if wait := time.Until(limit.Reset); wait > 0 {
+			if !x.canWaitRateLimit(ctx, waited, wait) {
+				return nil, &GitHubRateLimitError{StatusCode: 0, RetryAfter: wait}
+			}
+			log.WithField("wait", wait).Warn("Wait for reset of github rate limit")
+			if err := sleepContext(ctx, wait); err != nil {
+				return nil, err
+			}
+			waited += wait
+		}
+	}
+
+	for {
+		resp, err := x.send(ctx, method, apiURL, body)
+		if err != nil {
+			return nil, err
+		}
+		x.updateRateLimit(resource, resp)
+
+		wait, limited := rateLimitWait(resp)
+		if !limited {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		if !x.canWaitRateLimit(ctx, waited, wait) {
+			return nil, &GitHubRateLimitError{StatusCode: resp.StatusCode, RetryAfter: wait}
+		}
+
+		log.WithField("wait", wait).WithField("code", resp.StatusCode).
+			Warn("Rate limited by github, wait and retry")
+		if err := sleepContext(ctx, wait); err != nil {
+			return nil, err
+		}
+		waited += wait
+	}
+}
+
+// canWaitRateLimit returns true if additional wait is within the budget and
+// the deadline of ctx.
+func (x *GitHub) canWaitRateLimit(ctx context.Context, waited, wait time.Duration) bool {
+	if waited+wait > x.maxRateLimitWait {
+		return false
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+		return false
+	}
+	return true
+}
+
+// sleepContext waits for the duration or cancellation of ctx.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// isIdempotent returns true if sending the request again has the same effect.
+// POST creates an issue or a comment every time.
+func isIdempotent(method string) bool {
+	return method != "POST"
+}
+
+// isDialError returns true if the request failed to connect to the server,
+// then the server never received it.
+func isDialError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+//
+// send sends a request to GitHub API with the token. An idempotent request
+// is retried with exponential backoff on network errors and 5xx responses.
+// POST is retried only if it failed to connect, because GitHub may have
+// created the issue or comment even if the response is lost. The last
+// response is returned even if it's 5xx, and the caller must close its body.
+//
+func (x *GitHub) send(ctx context.Context, method, apiURL string, body []byte) (*http.Response, error) {
+	retryable := func(err error) error {
+		if isIdempotent(method) {
+			return err
+		}
+		return backoff.Permanent(err)
+	}
+
+	var resp *http.Response
+	operation := func() error {
+		if resp != nil {
+			resp.Body.Close()
+			resp = nil
+		}
+
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+
+		req, err := http.NewRequest(method, apiURL, reader)
+		if err != nil {
+			return backoff.Permanent(errors.Wrap(err, "Fail to build a request of github"))
+		}
+		req = req.WithContext(ctx)
+		req.Header.Add("Authorization", fmt.Sprintf("token %s", x.token))
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err = x.client.Do(req)
+		if ctx.Err() != nil {
+			return backoff.Permanent(ctx.Err())
+		} else if err != nil {
+			wrapped := errors.Wrapf(err, "Fail to send a request: %s %s", method, apiURL)
+			if isDialError(err) {
+				return wrapped
+			}
+			return retryable(wrapped)
+		}
+
+		if resp.StatusCode >= 500 {
+			return retryable(fmt.Errorf("Server error of github: %s %s, code: %d",
+				method, apiURL, resp.StatusCode))
+		}
+		return nil
+	}
+
+	var b backoff.BackOff = &backoff.StopBackOff{}
+	if x.maxRetryTime > 0 {
+		eb := backoff.NewExponentialBackOff()
+		eb.MaxElapsedTime = x.maxRetryTime
+		b = eb
+	}
+
+	notify := func(err error, wait time.Duration) {
+		log.WithError(err).WithField("wait", wait).Warn("Retry github request")
+	}
+
+	if err := backoff.RetryNotify(operation, backoff.WithContext(b, ctx), notify); err != nil && resp == nil {
+		return nil, err
 	}
-	// log.Println("req = ", req)
-	// log.Println("token len = ", len(x.token))
-	req.Header.Add("Authorization", fmt.Sprintf("token %s", x.token))
 
-	resp, err := client.Do(req)
+	return resp, nil
+}
+
+//
+// NewIssue creates an new issue on github with title and issue's body
+//
+func (x *GitHub) NewIssue(title, content string) (*GitHubIssue, error) {
+	return x.NewIssueWithContext(context.Background(), title, content)
+}
+
+//
+// NewIssueWithContext is NewIssue with context
+//
+func (x *GitHub) NewIssueWithContext(ctx context.Context, title, content string) (*GitHubIssue, error) {
+	return x.CreateIssueWithContext(ctx, GitHubIssueRequest{Title: title, Body: content})
+}
+
+//
+// CreateIssue creates an new issue on github with parameters including labels
+// and assignees. GitHub creates labels that do not exist in the repository.
+//
+func (x *GitHub) CreateIssue(issueReq GitHubIssueRequest) (*GitHubIssue, error) {
+	return x.CreateIssueWithContext(context.Background(), issueReq)
+}
+
+//
+// CreateIssueWithContext is CreateIssue with context
+//
+func (x *GitHub) CreateIssueWithContext(ctx context.Context, issueReq GitHubIssueRequest) (*GitHubIssue, error) {
+	url := fmt.Sprintf("%s/repos/%s/issues", x.endpoint, x.repository)
+	resp, err := x.request(ctx, "POST", url, issueReq)
 	if err != nil {
 		return nil, errors.Wrap(err, "Fail to create a github issue")
-	} else if resp.StatusCode != 201 {
-		return nil, errors.New(fmt.Sprintf("Fail to create a github issue, code: %d",
-			resp.StatusCode))
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		return nil, errors.Wrap(newGitHubAPIError(resp), "Fail to create a github issue")
 	}
 
 	return x.respToIssue(resp, nil)
@@ -105,29 +576,81 @@ func (x *GitHub) respToIssue(resp *http.Response, issue *GitHubIssue) (*GitHubIs
 // GetIssue returns existing an issue from github by URL for API
 //
 func (x *GitHub) GetIssue(apiURL string) (*GitHubIssue, error) {
-	client := &http.Client{}
+	return x.GetIssueWithContext(context.Background(), apiURL)
+}
 
-	req, err := http.NewRequest("GET", apiURL, nil)
+//
+// GetIssueWithContext is GetIssue with context
+//
+func (x *GitHub) GetIssueWithContext(ctx context.Context, apiURL string) (*GitHubIssue, error) {
+	resp, err := x.request(ctx, "GET", apiURL, nil)
 	if err != nil {
-		return nil, errors.Wrap(err, "Fail to build a request to get github issue")
+		return nil, errors.Wrap(err, "Fail to get a github issue")
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("token %s", x.token))
+	defer resp.Body.Close()
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, errors.Wrap(err, "Fail to get a github issue")
-	} else if resp.StatusCode != 200 {
-		return nil, errors.New(fmt.Sprintf("Fail to get a github issue, code: %d",
-			resp.StatusCode))
+	if resp.StatusCode != 200 {
+		return nil, errors.Wrap(newGitHubAPIError(resp), "Fail to get a github issue")
 	}
 
 	return x.respToIssue(resp, nil)
 }
 
+//
+// SearchIssues returns issues in the repository matched with the query by
+// GitHub search API. Issues are sorted by created time in ascending order.
+//
+func (x *GitHub) SearchIssues(query string) ([]*GitHubIssue, error) {
+	return x.SearchIssuesWithContext(context.Background(), query)
+}
+
+//
+// SearchIssuesWithContext is SearchIssues with context
+//
+func (x *GitHub) SearchIssuesWithContext(ctx context.Context, query string) ([]*GitHubIssue, error) {
+	q := fmt.Sprintf("%s repo:%s type:issue", query, x.repository)
+	apiURL := fmt.Sprintf("%s/search/issues?q=%s&sort=created&order=asc",
+		x.endpoint, url.QueryEscape(q))
+
+	resp, err := x.request(ctx, "GET", apiURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to search github issues")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, errors.Wrap(newGitHubAPIError(resp), "Fail to search github issues")
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to read body data of searching issues")
+	}
+
+	var result struct {
+		Items []*GitHubIssue `json:"items"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, errors.Wrap(err, "Fail to parse a result of searching issues")
+	}
+
+	for _, issue := range result.Items {
+		issue.github = x
+	}
+	return result.Items, nil
+}
+
 //
 // AppendContent appends additional body to existing issue
 //
 func (x *GitHubIssue) AppendContent(content string) error {
+	return x.AppendContentWithContext(context.Background(), content)
+}
+
+//
+// AppendContentWithContext is AppendContent with context
+//
+func (x *GitHubIssue) AppendContentWithContext(ctx context.Context, content string) error {
 	tempalte := "%s\n\n- - - - - - - - - -\n\n%s"
 	newBody := fmt.Sprintf(tempalte, x.Content, content)
 	updateReq := struct {
@@ -136,24 +659,14 @@ func (x *GitHubIssue) AppendContent(content string) error {
 		Body: newBody,
 	}
 
-	binData, err := json.Marshal(updateReq)
-	if err != nil {
-		return errors.Wrap(err, "Fail to create JSON message")
-	}
-
-	client := &http.Client{}
-	req, err := http.NewRequest("PATCH", x.ApiURL, bytes.NewReader(binData))
+	resp, err := x.github.request(ctx, "PATCH", x.ApiURL, updateReq)
 	if err != nil {
-		return errors.Wrap(err, "Fail to build a request to create github issue")
+		return errors.Wrap(err, "Fail to patch the issue")
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("token %s", x.github.token))
+	defer resp.Body.Close()
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return errors.Wrap(err, "Fail to patch the issue")
-	} else if resp.StatusCode != 200 {
-		return errors.New(fmt.Sprintf("Fail to patch the issue, code: %d",
-			resp.StatusCode))
+	if resp.StatusCode != 200 {
+		return errors.Wrap(newGitHubAPIError(resp), "Fail to patch the issue")
 	}
 
 	x.github.respToIssue(resp, x)
@@ -161,31 +674,24 @@ func (x *GitHubIssue) AppendContent(content string) error {
 }
 
 func (x *GitHubIssue) AddComment(comment string) (*GitHubIssueComment, error) {
+	return x.AddCommentWithContext(context.Background(), comment)
+}
+
+func (x *GitHubIssue) AddCommentWithContext(ctx context.Context, comment string) (*GitHubIssueComment, error) {
 	commentData := struct {
 		Body string `json:"body"`
 	}{
 		Body: comment,
 	}
-	binData, err := json.Marshal(commentData)
-	if err != nil {
-		return nil, errors.Wrap(err, "")
-	}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/comments", x.ApiURL),
-		bytes.NewReader(binData))
+	resp, err := x.github.request(ctx, "POST", fmt.Sprintf("%s/comments", x.ApiURL), commentData)
 	if err != nil {
-		return nil, errors.Wrap(err, "Fail to build a request to create github issue")
+		return nil, errors.Wrap(err, "Fail to post a comment")
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("token %s", x.github.token))
+	defer resp.Body.Close()
 
-	resp, err := client.Do(req)
-
-	if err != nil {
-		return nil, errors.Wrap(err, "Fail to post a comment")
-	} else if resp.StatusCode != 201 {
-		return nil, errors.New(fmt.Sprintf("Fail to post a comment, code: %d",
-			resp.StatusCode))
+	if resp.StatusCode != 201 {
+		return nil, errors.Wrap(newGitHubAPIError(resp), "Fail to post a comment")
 	}
 
 	respData, err := ioutil.ReadAll(resp.Body)
@@ -203,67 +709,705 @@ func (x *GitHubIssue) AddComment(comment string) (*GitHubIssueComment, error) {
 	return &c, nil
 }
 
-func (x *GitHubIssue) FetchComments() ([]string, error) {
-	results := []string{}
+//
+// FetchComments returns all comments of the issue by following pages
+//
+func (x *GitHubIssue) FetchComments() ([]GitHubIssueComment, error) {
+	return x.FetchCommentsWithContext(context.Background())
+}
+
+func (x *GitHubIssue) FetchCommentsWithContext(ctx context.Context) ([]GitHubIssueComment, error) {
+	results := []GitHubIssueComment{}
 
-	url := fmt.Sprintf("%s/comments", x.ApiURL)
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return results, errors.Wrap(err, "Fail to build get request of comment")
+	iter := x.Comments(ctx)
+	for iter.Next() {
+		results = append(results, iter.Comment())
+	}
+	if err := iter.Err(); err != nil {
+		return results, err
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("token %s", x.github.token))
 
-	resp, err := client.Do(req)
+	return results, nil
+}
+
+// githubCommentsPerPage is max number of comments in a page of GitHub API.
+const githubCommentsPerPage = 100
+
+//
+// Comments returns an iterator of comments of the issue. Pages are fetched
+// lazily while iterating.
+//
+func (x *GitHubIssue) Comments(ctx context.Context) *GitHubCommentIterator {
+	return &GitHubCommentIterator{
+		ctx:     ctx,
+		github:  x.github,
+		nextURL: fmt.Sprintf("%s/comments?per_page=%d", x.ApiURL, githubCommentsPerPage),
+	}
+}
+
+// GitHubCommentIterator reads comments of an issue page by page.
+//
+//	iter := issue.Comments(ctx)
+//	for iter.Next() {
+//		c := iter.Comment()
+//	}
+//	if err := iter.Err(); err != nil {
+//	}
+type GitHubCommentIterator struct {
+	ctx     context.Context
+	github  *GitHub
+	nextURL string
+	page    []GitHubIssueComment
+	current GitHubIssueComment
+	err     error
+}
+
+// Next advances the iterator to the next comment. It returns false at the
+// end of comments or on error.
+func (x *GitHubCommentIterator) Next() bool {
+	for len(x.page) == 0 {
+		if x.err != nil || x.nextURL == "" {
+			return false
+		}
+		x.page, x.nextURL, x.err = x.github.fetchCommentPage(x.ctx, x.nextURL)
+	}
+
+	x.current, x.page = x.page[0], x.page[1:]
+	return true
+}
+
+// Comment returns the current comment.
+func (x *GitHubCommentIterator) Comment() GitHubIssueComment {
+	return x.current
+}
+
+// Err returns the first error while iterating.
+func (x *GitHubCommentIterator) Err() error {
+	return x.err
+}
+
+// fetchCommentPage returns comments in the page and URL of the next page.
+func (x *GitHub) fetchCommentPage(ctx context.Context, pageURL string) ([]GitHubIssueComment, string, error) {
+	resp, err := x.request(ctx, "GET", pageURL, nil)
 	if err != nil {
-		return results, errors.Wrap(err, "Fail to get the issues")
-	} else if resp.StatusCode != 200 {
-		return results, errors.New(fmt.Sprintf("Fail to patch the issue, code: %d",
-			resp.StatusCode))
+		return nil, "", errors.Wrap(err, "Fail to get comments of the issue")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, "", errors.Wrap(newGitHubAPIError(resp), "Fail to get comments of the issue")
 	}
 
 	binData, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return results, errors.Wrap(err, "Fail to read body data of github comments")
+		return nil, "", errors.Wrap(err, "Fail to read body data of github comments")
 	}
-	type comment struct {
-		Body string `json:"body"`
+
+	comments := []GitHubIssueComment{}
+	if err := json.Unmarshal(binData, &comments); err != nil {
+		return nil, "", errors.Wrap(err, "Fail to parse json of github comments")
+	}
+
+	return comments, nextPageURL(resp.Header.Get("Link")), nil
+}
+
+// nextPageURL returns URL of rel="next" in Link header of GitHub API.
+// e.g. <https://api.github.com/...?page=2>; rel="next", <...>; rel="last"
+func nextPageURL(link string) string {
+	for _, part := range strings.Split(link, ",") {
+		sections := strings.Split(part, ";")
+		if len(sections) < 2 {
+			continue
+		}
+
+		u := strings.TrimSpace(sections[0])
+		if !strings.HasPrefix(u, "<") || !strings.HasSuffix(u, ">") {
+			continue
+		}
+
+		for _, param := range sections[1:] {
+			if strings.TrimSpace(param) == `rel="next"` {
+				return u[1 : len(u)-1]
+			}
+		}
+	}
+
+	return ""
+}
+
+//
+// HasLabel returns true if the issue has the label
+//
+func (x *GitHubIssue) HasLabel(name string) bool {
+	for _, label := range x.Labels {
+		if label.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// AddLabels adds labels to the issue. Existing labels are kept.
+//
+func (x *GitHubIssue) AddLabels(names ...string) error {
+	return x.AddLabelsWithContext(context.Background(), names...)
+}
+
+//
+// AddLabelsWithContext is AddLabels with context
+//
+func (x *GitHubIssue) AddLabelsWithContext(ctx context.Context, names ...string) error {
+	labelReq := struct {
+		Labels []string `json:"labels"`
+	}{
+		Labels: names,
 	}
-	comments := make([]comment, 0)
-	err = json.Unmarshal(binData, &comments)
+
+	resp, err := x.github.request(ctx, "POST", fmt.Sprintf("%s/labels", x.ApiURL), labelReq)
 	if err != nil {
-		return results, errors.Wrap(err, "Fail to parse json of github comments")
+		return errors.Wrap(err, "Fail to add labels to the issue")
 	}
+	defer resp.Body.Close()
 
-	for _, c := range comments {
-		results = append(results, c.Body)
+	if resp.StatusCode != 200 {
+		return errors.Wrap(newGitHubAPIError(resp), "Fail to add labels to the issue")
 	}
-	return results, nil
+
+	// The response is all labels of the issue.
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "Fail to read body data of adding labels")
+	}
+	labels := []GitHubLabel{}
+	if err := json.Unmarshal(body, &labels); err != nil {
+		return errors.Wrap(err, "Fail to parse a result of adding labels")
+	}
+	x.Labels = labels
+
+	return nil
+}
+
+//
+// RemoveLabel removes a label from the issue. It's not an error that the
+// issue does not have the label.
+//
+func (x *GitHubIssue) RemoveLabel(name string) error {
+	return x.RemoveLabelWithContext(context.Background(), name)
+}
+
+//
+// RemoveLabelWithContext is RemoveLabel with context
+//
+func (x *GitHubIssue) RemoveLabelWithContext(ctx context.Context, name string) error {
+	apiURL := fmt.Sprintf("%s/labels/%s", x.ApiURL, url.PathEscape(name))
+	resp, err := x.github.request(ctx, "DELETE", apiURL, nil)
+	if err != nil {
+		return errors.Wrap(err, "Fail to remove a label from the issue")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 && resp.StatusCode != 404 {
+		return errors.Wrap(newGitHubAPIError(resp), "Fail to remove a label from the issue")
+	}
+
+	labels := []GitHubLabel{}
+	for _, label := range x.Labels {
+		if label.Name != name {
+			labels = append(labels, label)
+		}
+	}
+	x.Labels = labels
+
+	return nil
+}
+
+//
+// HasAssignee returns true if the user is assigned to the issue
+//
+func (x *GitHubIssue) HasAssignee(login string) bool {
+	for _, user := range x.Assignees {
+		if strings.EqualFold(user.Login, login) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// AddAssigneesWithContext assigns users to the issue. Existing assignees are
+// kept.
+//
+func (x *GitHubIssue) AddAssigneesWithContext(ctx context.Context, logins ...string) error {
+	assigneeReq := struct {
+		Assignees []string `json:"assignees"`
+	}{
+		Assignees: logins,
+	}
+
+	resp, err := x.github.request(ctx, "POST", fmt.Sprintf("%s/assignees", x.ApiURL), assigneeReq)
+	if err != nil {
+		return errors.Wrap(err, "Fail to add assignees to the issue")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 201 {
+		return errors.Wrap(newGitHubAPIError(resp), "Fail to add assignees to the issue")
+	}
+
+	// The response is the issue with all assignees.
+	if _, err := x.github.respToIssue(resp, x); err != nil {
+		return err
+	}
+	return nil
+}
+
+const (
+	githubIssueOpen   = "open"
+	githubIssueClosed = "closed"
+)
+
+//
+// IsClosed returns true if the issue is closed
+//
+func (x *GitHubIssue) IsClosed() bool {
+	return x.State == githubIssueClosed
 }
 
 func (x *GitHubIssue) Close() error {
+	return x.CloseWithContext(context.Background())
+}
+
+func (x *GitHubIssue) CloseWithContext(ctx context.Context) error {
+	if err := x.setState(ctx, githubIssueClosed); err != nil {
+		return errors.Wrap(err, "Fail to close the issue")
+	}
+	return nil
+}
+
+//
+// Reopen reopens the closed issue
+//
+func (x *GitHubIssue) Reopen() error {
+	return x.ReopenWithContext(context.Background())
+}
+
+//
+// ReopenWithContext is Reopen with context
+//
+func (x *GitHubIssue) ReopenWithContext(ctx context.Context) error {
+	if err := x.setState(ctx, githubIssueOpen); err != nil {
+		return errors.Wrap(err, "Fail to reopen the issue")
+	}
+	return nil
+}
+
+func (x *GitHubIssue) setState(ctx context.Context, state string) error {
 	type issuePatch struct {
 		State string `json:"state"`
 	}
 
-	patch := issuePatch{"closed"}
-	body, err := json.Marshal(patch)
+	resp, err := x.github.request(ctx, "PATCH", x.ApiURL, issuePatch{state})
+	if err != nil {
+		return errors.Wrap(err, "Fail to patch the issue")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return errors.Wrap(newGitHubAPIError(resp), "Fail to patch the issue")
+	}
+
+	x.State = state
+	return nil
+}
+
+const githubSinkName = "github"
+
+// reportIDMarker returns a marker of the report written at the top of issue
+// body. It's used to find the issue by GitHub search API.
+func reportIDMarker(reportID ar.ReportID) string {
+	return fmt.Sprintf("ReportID: %s", reportID)
+}
+
+// GitHubSink publishes a report as a GitHub issue. A new alert is appended
+// to the issue body and a published report is posted as a comment. The
+// repository of the issue is chosen by the router and saved in the cache.
+type GitHubSink struct {
+	github *GitHub
+	repos  map[string]*GitHub
+	router *Router
+
+	// SectionOrder sorts sections of published reports.
+	SectionOrder SectionOrder
+}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("PATCH", x.ApiURL, bytes.NewReader(body))
+// GitHubSinkOption is an optional setting of GitHubSink.
+type GitHubSinkOption func(x *GitHubSink)
 
+// WithRouter sets a router to decide repository, assignees and mentions of
+// new issues.
+func WithRouter(router *Router) GitHubSinkOption {
+	return func(x *GitHubSink) {
+		x.router = router
+	}
+}
+
+// WithRepository adds an accessor of a repository that can be chosen by the
+// router other than the default one.
+func WithRepository(github *GitHub) GitHubSinkOption {
+	return func(x *GitHubSink) {
+		x.repos[repositoryKey(github.endpoint, github.repository)] = github
+	}
+}
+
+func repositoryKey(endpoint, repository string) string {
+	return strings.TrimRight(endpoint, "/") + " " + repository
+}
+
+// NewGitHubSink returns a sink for GitHub issues. github is the accessor of
+// the default repository.
+func NewGitHubSink(github *GitHub, options ...GitHubSinkOption) *GitHubSink {
+	x := &GitHubSink{
+		github: github,
+		repos:  map[string]*GitHub{},
+	}
+	for _, opt := range options {
+		opt(x)
+	}
+	return x
+}
+
+func (x *GitHubSink) Name() string { return githubSinkName }
+
+// repository returns an accessor of the repository. Empty repository means
+// the default one, and empty endpoint means the default endpoint.
+func (x *GitHubSink) repository(endpoint, repository string) (*GitHub, error) {
+	if repository == "" {
+		return x.github, nil
+	}
+	if endpoint == "" {
+		endpoint = x.github.endpoint
+	}
+
+	key := repositoryKey(endpoint, repository)
+	if github, ok := x.repos[key]; ok {
+		return github, nil
+	}
+	if key == repositoryKey(x.github.endpoint, x.github.repository) {
+		return x.github, nil
+	}
+
+	return nil, fmt.Errorf("GitHub repository is not configured: %s %s", endpoint, repository)
+}
+
+// cachedRepository returns an accessor of the repository that owns the issue.
+func (x *GitHubSink) cachedRepository(cache *ReportCache) (*GitHub, error) {
+	return x.repository(cache.Endpoint, cache.Repository)
+}
+
+func (x *GitHubSink) newIssue(ctx context.Context, report ar.Report, cache *ReportCache) (*GitHubIssue, error) {
+	route := x.router.Route(report)
+	github, err := x.repository(route.Endpoint, route.Repository)
 	if err != nil {
-		return errors.Wrap(err, "Fail to build patch request of issue")
+		return nil, err
 	}
-	req.Header.Add("Authorization", fmt.Sprintf("token %s", x.github.token))
 
-	resp, err := client.Do(req)
+	body := BuildIssueBody(report, route.Mentions...)
+	title := report.Alert.Title()
+	body = reportIDMarker(report.ID) + "\n\n" + body
+
+	issue, err := github.CreateIssueWithContext(ctx, GitHubIssueRequest{
+		Title:     title,
+		Body:      body,
+		Labels:    reportLabels(report),
+		Assignees: route.Assignees,
+	})
 	if err != nil {
-		return errors.Wrap(err, "Fail to close the issues")
-	} else if resp.StatusCode != 200 {
-		return errors.New(fmt.Sprintf("Fail to patch the issue, code: %d",
-			resp.StatusCode))
+		return nil, errors.Wrap(err, "Fail to create GHE issue")
+	}
+	cache.IssueURL = issue.ApiURL
+	cache.HtmlURL = issue.HtmlURL
+	cache.Repository = route.Repository
+	cache.Endpoint = route.Endpoint
+	cache.Mentions = route.Mentions
+
+	return issue, nil
+}
+
+// getIssue returns the issue of the report. If the issue has been deleted
+// or transferred, it creates a new issue for the report instead and returns
+// created as true.
+func (x *GitHubSink) getIssue(ctx context.Context, report ar.Report, cache *ReportCache) (issue *GitHubIssue, created bool, err error) {
+	github, err := x.cachedRepository(cache)
+	if err != nil {
+		return nil, false, err
+	}
+
+	issue, err = github.GetIssueWithContext(ctx, cache.IssueURL)
+	if IsNotFound(err) {
+		log.WithError(err).WithField("issue", cache.IssueURL).
+			Warn("GHE issue is not found, then create a new one")
+		issue, err = x.newIssue(ctx, report, cache)
+		return issue, true, err
+	} else if err != nil {
+		return nil, false, errors.Wrap(err, "Fail to get GHE issue")
+	}
+
+	return issue, false, nil
+}
+
+// syncRoute evaluates the route again because severity and status of the
+// report may have changed since the issue was created. Missing assignees are
+// added and new mentions are CC'd by a comment. The issue stays in the
+// repository where it was created.
+func (x *GitHubSink) syncRoute(ctx context.Context, issue *GitHubIssue, report ar.Report, cache *ReportCache) error {
+	route := x.router.Route(report)
+
+	var assignees []string
+	for _, login := range route.Assignees {
+		if !issue.HasAssignee(login) {
+			assignees = append(assignees, login)
+		}
+	}
+	if len(assignees) > 0 {
+		if err := issue.AddAssigneesWithContext(ctx, assignees...); err != nil {
+			return errors.Wrap(err, "Fail to add assignees to GHE issue")
+		}
+	}
+
+	// Issues created before mentions were cached have them only in the body.
+	mentioned := appendUnique(issueMentions(issue.Content), cache.Mentions...)
+	var mentions []string
+	for _, mention := range route.Mentions {
+		if !containsString(mentioned, mention) {
+			mentions = append(mentions, mention)
+		}
+	}
+	if len(mentions) > 0 {
+		if _, err := issue.AddCommentWithContext(ctx, BuildMentionComment(report, mentions...)); err != nil {
+			return errors.Wrap(err, "Fail to add a mention comment to GHE issue")
+		}
+		cache.Mentions = appendUnique(mentioned, mentions...)
 	}
 
 	return nil
 }
+
+// issueMentions returns mentions in CC lines of the issue body.
+func issueMentions(content string) []string {
+	var mentions []string
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(line, "- CC: ") {
+			mentions = appendUnique(mentions, strings.Fields(strings.TrimPrefix(line, "- CC: "))...)
+		}
+	}
+	return mentions
+}
+
+// syncLabels adds labels of the report that the issue does not have yet, and
+// removes a severity label other than the current one. Other labels set by
+// hand are kept.
+func (x *GitHubSink) syncLabels(ctx context.Context, issue *GitHubIssue, report ar.Report) error {
+	current := severityLabel(report)
+	if current != "" {
+		for _, label := range issue.Labels {
+			if strings.HasPrefix(label.Name, severityLabelPrefix) && label.Name != current {
+				if err := issue.RemoveLabelWithContext(ctx, label.Name); err != nil {
+					return errors.Wrap(err, "Fail to remove old severity label")
+				}
+			}
+		}
+	}
+
+	var missing []string
+	for _, label := range reportLabels(report) {
+		if !issue.HasLabel(label) {
+			missing = append(missing, label)
+		}
+	}
+	if len(missing) > 0 {
+		if err := issue.AddLabelsWithContext(ctx, missing...); err != nil {
+			return errors.Wrap(err, "Fail to add labels to GHE issue")
+		}
+	}
+
+	return nil
+}
+
+func (x *GitHubSink) Create(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	issue, err := x.newIssue(ctx, report, cache)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SinkResult{
+		Sink:    x.Name(),
+		Action:  sinkCreate,
+		ApiURL:  issue.ApiURL,
+		HtmlURL: issue.HtmlURL,
+	}, nil
+}
+
+// Recover searches the issue by the ReportID marker in issue body of the
+// repository chosen by the router. The oldest one is chosen if there are
+// duplicated issues.
+func (x *GitHubSink) Recover(ctx context.Context, report ar.Report, cache *ReportCache) (bool, error) {
+	route := x.router.Route(report)
+	github, err := x.repository(route.Endpoint, route.Repository)
+	if err != nil {
+		return false, err
+	}
+
+	marker := reportIDMarker(report.ID)
+	issues, err := github.SearchIssuesWithContext(ctx, fmt.Sprintf(`"%s" in:body`, marker))
+	if err != nil {
+		return false, errors.Wrap(err, "Fail to search GHE issue")
+	}
+
+	for _, issue := range issues {
+		// Search API matches words loosely, then check the marker strictly.
+		firstLine := strings.SplitN(issue.Content, "\n", 2)[0]
+		if strings.TrimSpace(firstLine) != marker {
+			continue
+		}
+
+		cache.IssueURL = issue.ApiURL
+		cache.HtmlURL = issue.HtmlURL
+		cache.Repository = route.Repository
+		cache.Endpoint = route.Endpoint
+		cache.Mentions = issueMentions(issue.Content)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (x *GitHubSink) Update(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	issue, created, err := x.getIssue(ctx, report, cache)
+	if err != nil {
+		return nil, err
+	}
+
+	// A new issue already has the content.
+	if !created {
+		if err := issue.AppendContentWithContext(ctx, BuildIssueBody(report)); err != nil {
+			return nil, errors.Wrap(err, "Fail to append content to GHE issue")
+		}
+		if err := x.syncLabels(ctx, issue, report); err != nil {
+			return nil, err
+		}
+		if err := x.syncRoute(ctx, issue, report, cache); err != nil {
+			return nil, err
+		}
+	}
+
+	return &SinkResult{
+		Sink:    x.Name(),
+		Action:  sinkUpdate,
+		ApiURL:  issue.ApiURL,
+		HtmlURL: issue.HtmlURL,
+	}, nil
+}
+
+func (x *GitHubSink) Comment(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	issue, created, err := x.getIssue(ctx, report, cache)
+	if err != nil {
+		return nil, err
+	}
+
+	// Severity is decided by publishing, then swap the severity label and
+	// route the issue again.
+	if !created {
+		if err := x.syncLabels(ctx, issue, report); err != nil {
+			return nil, err
+		}
+		if err := x.syncRoute(ctx, issue, report, cache); err != nil {
+			return nil, err
+		}
+	}
+
+	// The issue was closed as safe, but the report escalates again.
+	if issue.IsClosed() && report.Result.Severity != ar.SevSafe {
+		if err := issue.ReopenWithContext(ctx); err != nil {
+			return nil, errors.Wrap(err, "Fail to reopen GHE issue")
+		}
+		if _, err := issue.AddCommentWithContext(ctx, BuildReopenComment(report)); err != nil {
+			return nil, errors.Wrap(err, "Fail to add a reopen comment to GHE issue")
+		}
+	}
+
+	body := BuildPublishedReportHeader(report) + BuildCommentBody(report, x.SectionOrder)
+	comment, err := issue.AddCommentWithContext(ctx, body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to add a comment to GHE issue")
+	}
+	cache.CommentHtmlURL = comment.HtmlURL
+
+	return &SinkResult{
+		Sink:    x.Name(),
+		Action:  sinkComment,
+		ApiURL:  comment.ApiURL,
+		HtmlURL: comment.HtmlURL,
+	}, nil
+}
+
+func (x *GitHubSink) Resolve(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	github, err := x.cachedRepository(cache)
+	if err != nil {
+		return nil, err
+	}
+
+	issue, err := github.GetIssueWithContext(ctx, cache.IssueURL)
+	if IsNotFound(err) {
+		// Nothing to close.
+		log.WithField("issue", cache.IssueURL).Warn("GHE issue is not found")
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "Fail to get GHE issue")
+	}
+
+	if err := issue.CloseWithContext(ctx); err != nil {
+		return nil, errors.Wrap(err, "Fail to close GHE issue")
+	}
+
+	return &SinkResult{
+		Sink:    x.Name(),
+		Action:  sinkResolve,
+		ApiURL:  issue.ApiURL,
+		HtmlURL: issue.HtmlURL,
+	}, nil
+}
+
+func newGitHubSink(secrets secretValues) (*GitHubSink, error) {
+	ghe, err := NewGitHub(secrets.GithubEndpoint, secrets.GithubRepository, secrets.GithubToken)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to create github accessor")
+	}
+
+	// The first rule of each repository decides its token.
+	options := []GitHubSinkOption{WithRouter(NewRouter(secrets.Routes))}
+	configured := map[string]bool{}
+	for _, rule := range secrets.Routes {
+		endpoint, token := rule.Endpoint, rule.Token
+		if endpoint == "" {
+			endpoint = secrets.GithubEndpoint
+		}
+		if token == "" {
+			token = secrets.GithubToken
+		}
+
+		key := repositoryKey(endpoint, rule.Repository)
+		if rule.Repository == "" || configured[key] {
+			continue
+		}
+		configured[key] = true
+
+		repo, err := NewGitHub(endpoint, rule.Repository, token)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Fail to create github accessor for %s", rule.Repository)
+		}
+		options = append(options, WithRepository(repo))
+	}
+
+	return NewGitHubSink(ghe, options...), nil
+}
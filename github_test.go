@@ -1,9 +1,19 @@
 package main_test
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	main "github.com/m-mizutani/GithubEmitter"
+	"github.com/pkg/errors"
 
 	uuid "github.com/satori/go.uuid"
 	"github.com/stretchr/testify/assert"
@@ -65,6 +75,275 @@ func TestGitHubIssue(t *testing.T) {
 
 	comments, err = issue.FetchComments()
 	require.Equal(t, 1, len(comments))
-	require.Equal(t, comment, comments[0])
+	require.Equal(t, comment, comments[0].Body)
 
 }
+
+func TestGitHubRetry(t *testing.T) {
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		w.Write([]byte(`{"url":"https://api.example.com/issues/1","title":"TITLE"}`))
+	}))
+	defer ts.Close()
+
+	ghe, err := main.NewGitHub(ts.URL, "blue/five", "xxx")
+	require.NoError(t, err)
+
+	issue, err := ghe.GetIssue(ts.URL + "/repos/blue/five/issues/1")
+	require.NoError(t, err)
+	assert.Equal(t, "https://api.example.com/issues/1", issue.ApiURL)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&count))
+
+	// No retry
+	atomic.StoreInt32(&count, 0)
+	ghe, err = main.NewGitHub(ts.URL, "blue/five", "xxx", main.WithMaxRetryTime(0))
+	require.NoError(t, err)
+	_, err = ghe.GetIssue(ts.URL + "/repos/blue/five/issues/1")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+}
+
+// dialFailure fails to connect for the number of times.
+type dialFailure struct {
+	fails int32
+}
+
+func (x *dialFailure) RoundTrip(req *http.Request) (*http.Response, error) {
+	if atomic.AddInt32(&x.fails, -1) >= 0 {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestGitHubRetryPost(t *testing.T) {
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The issue is created, but the response is lost.
+		if atomic.AddInt32(&count, 1) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), "TITLE")
+
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"url":"https://api.example.com/issues/1","title":"TITLE"}`))
+	}))
+	defer ts.Close()
+
+	ghe, err := main.NewGitHub(ts.URL, "blue/five", "xxx")
+	require.NoError(t, err)
+
+	// POST is not retried to avoid a duplicated issue.
+	_, err = ghe.NewIssue("TITLE", "BODY")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&count))
+
+	// POST is retried if it did not reach the server.
+	ghe, err = main.NewGitHub(ts.URL, "blue/five", "xxx", main.WithTransport(&dialFailure{fails: 2}))
+	require.NoError(t, err)
+	issue, err := ghe.NewIssue("TITLE", "BODY")
+	require.NoError(t, err)
+	assert.Equal(t, "https://api.example.com/issues/1", issue.ApiURL)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+}
+
+func TestGitHubTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 50 * time.Millisecond}
+	ghe, err := main.NewGitHub(ts.URL, "blue/five", "xxx",
+		main.WithHTTPClient(client), main.WithMaxRetryTime(200*time.Millisecond))
+	require.NoError(t, err)
+
+	_, err = ghe.GetIssue(ts.URL + "/repos/blue/five/issues/1")
+	assert.Error(t, err)
+}
+
+func TestGitHubRateLimit(t *testing.T) {
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reset := fmt.Sprintf("%d", time.Now().Add(time.Hour).Unix())
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Reset", reset)
+
+		switch atomic.AddInt32(&count, 1) {
+		case 1: // secondary rate limit
+			w.Header().Set("X-RateLimit-Remaining", "10")
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusForbidden)
+		case 2:
+			w.Header().Set("X-RateLimit-Remaining", "9")
+			w.Write([]byte(`{"url":"https://api.example.com/issues/1"}`))
+		default: // primary rate limit
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer ts.Close()
+
+	ghe, err := main.NewGitHub(ts.URL, "blue/five", "xxx", main.WithMaxRateLimitWait(3*time.Second))
+	require.NoError(t, err)
+
+	issue, err := ghe.GetIssue(ts.URL + "/repos/blue/five/issues/1")
+	require.NoError(t, err)
+	assert.Equal(t, "https://api.example.com/issues/1", issue.ApiURL)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&count))
+
+	limit, ok := ghe.RateLimit("core")
+	require.True(t, ok)
+	assert.Equal(t, 5000, limit.Limit)
+	assert.Equal(t, 9, limit.Remaining)
+
+	// Reset time exceeds the budget, then it should fail fast.
+	_, err = ghe.GetIssue(ts.URL + "/repos/blue/five/issues/1")
+	require.Error(t, err)
+	_, ok = errors.Cause(err).(*main.GitHubRateLimitError)
+	assert.True(t, ok)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&count))
+
+	// Quota is exhausted, then the request should not be sent.
+	limit, _ = ghe.RateLimit("core")
+	assert.Equal(t, 0, limit.Remaining)
+	_, err = ghe.GetIssue(ts.URL + "/repos/blue/five/issues/1")
+	require.Error(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&count))
+}
+
+func TestGitHubAPIError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-GitHub-Request-Id", "ABCD:1234")
+		switch r.Method {
+		case "POST":
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{
+				"message": "Validation Failed",
+				"errors": [
+					{"resource": "Issue", "field": "title", "code": "missing_field"},
+					"plain message"
+				],
+				"documentation_url": "https://developer.github.com/v3/issues/#create-an-issue"
+			}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "Not Found"}`))
+		}
+	}))
+	defer ts.Close()
+
+	ghe, err := main.NewGitHub(ts.URL, "blue/five", "xxx")
+	require.NoError(t, err)
+
+	_, err = ghe.NewIssue("", "BODY")
+	require.Error(t, err)
+	assert.True(t, main.IsValidation(err))
+	assert.False(t, main.IsNotFound(err))
+	assert.False(t, main.IsRateLimited(err))
+
+	apiErr, ok := errors.Cause(err).(*main.GitHubAPIError)
+	require.True(t, ok)
+	assert.Equal(t, 422, apiErr.StatusCode)
+	assert.Equal(t, "ABCD:1234", apiErr.RequestID)
+	assert.Equal(t, "Validation Failed", apiErr.Message)
+	assert.Contains(t, apiErr.DocumentationURL, "create-an-issue")
+	require.Equal(t, 2, len(apiErr.Errors))
+	assert.Equal(t, "missing_field", apiErr.Errors[0].Code)
+	assert.Equal(t, "plain message", apiErr.Errors[1].Message)
+	assert.Contains(t, err.Error(), "Issue.title: missing_field")
+
+	_, err = ghe.GetIssue(ts.URL + "/repos/blue/five/issues/1")
+	require.Error(t, err)
+	assert.True(t, main.IsNotFound(err))
+	assert.False(t, main.IsValidation(err))
+}
+
+func TestGitHubContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	ghe, err := main.NewGitHub(ts.URL, "blue/five", "xxx")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = ghe.GetIssueWithContext(ctx, ts.URL+"/repos/blue/five/issues/1")
+	assert.Error(t, err)
+	assert.Equal(t, context.DeadlineExceeded, errors.Cause(err))
+	// Should not wait for retry
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+}
+
+func TestGitHubFetchCommentsPagination(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/blue/five/issues/1" {
+			w.Write([]byte(fmt.Sprintf(`{"url":"%s%s"}`, ts.URL, r.URL.Path)))
+			return
+		}
+		assert.Equal(t, "/repos/blue/five/issues/1/comments", r.URL.Path)
+
+		page := r.URL.Query().Get("page")
+		next := map[string]string{"": "2", "2": "3"}[page]
+		if next != "" {
+			w.Header().Set("Link", fmt.Sprintf(
+				`<%s%s?per_page=2&page=%s>; rel="next", <%s%s?per_page=2&page=3>; rel="last"`,
+				ts.URL, r.URL.Path, next, ts.URL, r.URL.Path))
+		}
+
+		base := map[string]int{"": 0, "2": 2, "3": 4}[page]
+		comments := []map[string]interface{}{}
+		for i := base; i < base+2 && i < 5; i++ {
+			comments = append(comments, map[string]interface{}{
+				"id":         i + 1,
+				"body":       fmt.Sprintf("comment %d", i+1),
+				"user":       map[string]interface{}{"login": "mizutani"},
+				"created_at": "2019-04-24T07:24:53Z",
+				"updated_at": "2019-04-25T07:24:53Z",
+			})
+		}
+		json.NewEncoder(w).Encode(comments)
+	}))
+	defer ts.Close()
+
+	ghe, err := main.NewGitHub(ts.URL, "blue/five", "xxx")
+	require.NoError(t, err)
+	issue, err := ghe.GetIssue(ts.URL + "/repos/blue/five/issues/1")
+	require.NoError(t, err)
+
+	comments, err := issue.FetchComments()
+	require.NoError(t, err)
+	require.Equal(t, 5, len(comments))
+	assert.Equal(t, int64(1), comments[0].ID)
+	assert.Equal(t, "comment 5", comments[4].Body)
+	assert.Equal(t, "mizutani", comments[4].User.Login)
+	assert.Equal(t, 2019, comments[4].CreatedAt.Year())
+	assert.True(t, comments[4].UpdatedAt.After(comments[4].CreatedAt))
+
+	// Iterator
+	iter := issue.Comments(context.Background())
+	count := 0
+	for iter.Next() {
+		count++
+		assert.Equal(t, int64(count), iter.Comment().ID)
+	}
+	assert.NoError(t, iter.Err())
+	assert.Equal(t, 5, count)
+}
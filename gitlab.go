@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultGitLabTimeout = 30 * time.Second
+
+// GitLabAPIError is an error response of GitLab API. Message is a string or
+// errors of fields in GitLab, then it's flattened to a string.
+type GitLabAPIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (x *GitLabAPIError) Error() string {
+	return fmt.Sprintf("GitLab API error (%d): %s", x.StatusCode, x.Message)
+}
+
+// IsGitLabNotFound returns true if the error means that the issue does not
+// exist or the user can not see it.
+func IsGitLabNotFound(err error) bool {
+	apiErr, ok := errors.Cause(err).(*GitLabAPIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+func newGitLabAPIError(statusCode int, body []byte) *GitLabAPIError {
+	apiErr := &GitLabAPIError{StatusCode: statusCode}
+
+	var resp struct {
+		Message interface{} `json:"message"`
+		Error   string      `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		apiErr.Message = strings.TrimSpace(string(body))
+		return apiErr
+	}
+
+	switch msg := resp.Message.(type) {
+	case string:
+		apiErr.Message = msg
+	case nil:
+		apiErr.Message = resp.Error
+	default:
+		raw, _ := json.Marshal(msg)
+		apiErr.Message = string(raw)
+	}
+	return apiErr
+}
+
+const gitlabIssueClosed = "closed"
+
+// GitLabIssue is an issue of GitLab. An issue is addressed by ProjectID and
+// IID that is an issue number in the project.
+type GitLabIssue struct {
+	ID          int64    `json:"id"`
+	IID         int64    `json:"iid"`
+	ProjectID   int64    `json:"project_id"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	State       string   `json:"state"`
+	WebURL      string   `json:"web_url"`
+	Labels      []string `json:"labels"`
+}
+
+// IsClosed returns true if the issue is closed.
+func (x *GitLabIssue) IsClosed() bool {
+	return x.State == gitlabIssueClosed
+}
+
+// GitLabIssueRequest is parameters to create a new issue.
+type GitLabIssueRequest struct {
+	Title       string
+	Description string
+	Labels      []string
+}
+
+// GitLab is an accessor of GitLab API v4 for a project. project is a numeric
+// ID or a path like "group/project".
+type GitLab struct {
+	endpoint string
+	project  string
+	token    string
+	client   *http.Client
+}
+
+// NewGitLab returns a GitLab accessor. endpoint is URL of API, e.g.
+// https://gitlab.example.com/api/v4
+func NewGitLab(endpoint, project, token string) *GitLab {
+	return &GitLab{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		project:  project,
+		token:    token,
+		client:   &http.Client{Timeout: defaultGitLabTimeout},
+	}
+}
+
+// projectPath returns API path of the project. GitLab requires URL encoded
+// path for a project addressed by the path.
+func projectPath(project string) string {
+	return "/projects/" + url.PathEscape(project)
+}
+
+func (x *GitLab) request(ctx context.Context, method, path string, data, result interface{}) error {
+	var body []byte
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return errors.Wrap(err, "Fail to marshal GitLab request")
+		}
+		body = raw
+	}
+
+	req, err := http.NewRequest(method, x.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "Fail to create GitLab request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("PRIVATE-TOKEN", x.token)
+
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Fail to send GitLab request")
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "Fail to read GitLab response")
+	}
+
+	if resp.StatusCode < 200 || 300 <= resp.StatusCode {
+		return newGitLabAPIError(resp.StatusCode, raw)
+	}
+
+	if result != nil {
+		if err := json.Unmarshal(raw, result); err != nil {
+			return errors.Wrap(err, "Fail to parse GitLab response")
+		}
+	}
+	return nil
+}
+
+// CreateIssue creates a new issue in the project. GitLab creates labels that
+// do not exist in the project.
+func (x *GitLab) CreateIssue(ctx context.Context, issueReq GitLabIssueRequest) (*GitLabIssue, error) {
+	data := map[string]string{
+		"title":       issueReq.Title,
+		"description": issueReq.Description,
+	}
+	if len(issueReq.Labels) > 0 {
+		data["labels"] = strings.Join(issueReq.Labels, ",")
+	}
+
+	var issue GitLabIssue
+	if err := x.request(ctx, "POST", projectPath(x.project)+"/issues", data, &issue); err != nil {
+		return nil, errors.Wrap(err, "Fail to create a GitLab issue")
+	}
+	return &issue, nil
+}
+
+func issuePath(projectID, iid int64) string {
+	return fmt.Sprintf("%s/issues/%d", projectPath(fmt.Sprint(projectID)), iid)
+}
+
+// GetIssue returns the issue by project ID and IID.
+func (x *GitLab) GetIssue(ctx context.Context, projectID, iid int64) (*GitLabIssue, error) {
+	var issue GitLabIssue
+	if err := x.request(ctx, "GET", issuePath(projectID, iid), nil, &issue); err != nil {
+		return nil, errors.Wrap(err, "Fail to get a GitLab issue")
+	}
+	return &issue, nil
+}
+
+// SearchIssues returns issues in the project that have the text in
+// description, in order of creation.
+func (x *GitLab) SearchIssues(ctx context.Context, text string) ([]*GitLabIssue, error) {
+	q := url.Values{}
+	q.Set("search", text)
+	q.Set("in", "description")
+	q.Set("order_by", "created_at")
+	q.Set("sort", "asc")
+
+	var issues []*GitLabIssue
+	path := projectPath(x.project) + "/issues?" + q.Encode()
+	if err := x.request(ctx, "GET", path, nil, &issues); err != nil {
+		return nil, errors.Wrap(err, "Fail to search GitLab issues")
+	}
+	return issues, nil
+}
+
+func (x *GitLab) updateIssue(ctx context.Context, issue *GitLabIssue, data map[string]string) error {
+	return x.request(ctx, "PUT", issuePath(issue.ProjectID, issue.IID), data, issue)
+}
+
+// AppendDescription appends content to description of the issue.
+func (x *GitLab) AppendDescription(ctx context.Context, issue *GitLabIssue, content string) error {
+	desc := fmt.Sprintf("%s\n\n- - - - - - - - - -\n\n%s", issue.Description, content)
+	if err := x.updateIssue(ctx, issue, map[string]string{"description": desc}); err != nil {
+		return errors.Wrap(err, "Fail to update description of GitLab issue")
+	}
+	return nil
+}
+
+// UpdateLabels adds and removes labels of the issue.
+func (x *GitLab) UpdateLabels(ctx context.Context, issue *GitLabIssue, add, remove []string) error {
+	data := map[string]string{}
+	if len(add) > 0 {
+		data["add_labels"] = strings.Join(add, ",")
+	}
+	if len(remove) > 0 {
+		data["remove_labels"] = strings.Join(remove, ",")
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	if err := x.updateIssue(ctx, issue, data); err != nil {
+		return errors.Wrap(err, "Fail to update labels of GitLab issue")
+	}
+	return nil
+}
+
+// AddNote posts a note (comment) to the issue and returns ID of the note.
+func (x *GitLab) AddNote(ctx context.Context, issue *GitLabIssue, body string) (int64, error) {
+	var note struct {
+		ID int64 `json:"id"`
+	}
+	path := issuePath(issue.ProjectID, issue.IID) + "/notes"
+	if err := x.request(ctx, "POST", path, map[string]string{"body": body}, &note); err != nil {
+		return 0, errors.Wrap(err, "Fail to add a note to GitLab issue")
+	}
+	return note.ID, nil
+}
+
+// Close closes the issue.
+func (x *GitLab) Close(ctx context.Context, issue *GitLabIssue) error {
+	if err := x.updateIssue(ctx, issue, map[string]string{"state_event": "close"}); err != nil {
+		return errors.Wrap(err, "Fail to close GitLab issue")
+	}
+	return nil
+}
+
+// Reopen reopens the closed issue.
+func (x *GitLab) Reopen(ctx context.Context, issue *GitLabIssue) error {
+	if err := x.updateIssue(ctx, issue, map[string]string{"state_event": "reopen"}); err != nil {
+		return errors.Wrap(err, "Fail to reopen GitLab issue")
+	}
+	return nil
+}
+
+const gitlabSinkName = "gitlab"
+
+// GitLabSink publishes a report as a GitLab issue in the same way as
+// GitHubSink. BuildIssueBody output is GitLab-flavored Markdown as it is.
+type GitLabSink struct {
+	gitlab *GitLab
+
+	// SectionOrder sorts sections of published reports.
+	SectionOrder SectionOrder
+}
+
+// NewGitLabSink returns a sink for GitLab issues.
+func NewGitLabSink(gitlab *GitLab) *GitLabSink {
+	return &GitLabSink{gitlab: gitlab}
+}
+
+func (x *GitLabSink) Name() string { return gitlabSinkName }
+
+func (x *GitLabSink) setCache(issue *GitLabIssue, cache *ReportCache) {
+	cache.GitLabProjectID = issue.ProjectID
+	cache.GitLabIID = issue.IID
+	cache.GitLabURL = issue.WebURL
+}
+
+func (x *GitLabSink) newIssue(ctx context.Context, report ar.Report, cache *ReportCache) (*GitLabIssue, error) {
+	issue, err := x.gitlab.CreateIssue(ctx, GitLabIssueRequest{
+		Title:       report.Alert.Title(),
+		Description: reportIDMarker(report.ID) + "\n\n" + BuildIssueBody(report),
+		Labels:      reportLabels(report),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	x.setCache(issue, cache)
+	return issue, nil
+}
+
+// getIssue returns the issue of the report, or creates a new issue if it has
+// been deleted and returns created as true.
+func (x *GitLabSink) getIssue(ctx context.Context, report ar.Report, cache *ReportCache) (issue *GitLabIssue, created bool, err error) {
+	if cache.GitLabIID != 0 {
+		issue, err = x.gitlab.GetIssue(ctx, cache.GitLabProjectID, cache.GitLabIID)
+		if err == nil {
+			return issue, false, nil
+		} else if !IsGitLabNotFound(err) {
+			return nil, false, err
+		}
+		log.WithError(err).WithField("issue", cache.GitLabURL).
+			Warn("GitLab issue is not found, then create a new one")
+	}
+
+	issue, err = x.newIssue(ctx, report, cache)
+	return issue, true, err
+}
+
+func (x *GitLabSink) result(action string, issue *GitLabIssue) *SinkResult {
+	return &SinkResult{
+		Sink:    x.Name(),
+		Action:  action,
+		ApiURL:  x.gitlab.endpoint + issuePath(issue.ProjectID, issue.IID),
+		HtmlURL: issue.WebURL,
+	}
+}
+
+func (x *GitLabSink) Create(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	issue, err := x.newIssue(ctx, report, cache)
+	if err != nil {
+		return nil, err
+	}
+	return x.result(sinkCreate, issue), nil
+}
+
+// Recover searches the issue by the ReportID marker in description.
+func (x *GitLabSink) Recover(ctx context.Context, report ar.Report, cache *ReportCache) (bool, error) {
+	marker := reportIDMarker(report.ID)
+	issues, err := x.gitlab.SearchIssues(ctx, marker)
+	if err != nil {
+		return false, err
+	}
+
+	for _, issue := range issues {
+		firstLine := strings.SplitN(issue.Description, "\n", 2)[0]
+		if strings.TrimSpace(firstLine) != marker {
+			continue
+		}
+
+		x.setCache(issue, cache)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (x *GitLabSink) Update(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	issue, created, err := x.getIssue(ctx, report, cache)
+	if err != nil {
+		return nil, err
+	}
+
+	if !created {
+		if err := x.gitlab.AppendDescription(ctx, issue, BuildIssueBody(report)); err != nil {
+			return nil, err
+		}
+	}
+
+	return x.result(sinkUpdate, issue), nil
+}
+
+func (x *GitLabSink) Comment(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	issue, created, err := x.getIssue(ctx, report, cache)
+	if err != nil {
+		return nil, err
+	}
+
+	// Swap the severity label decided by publishing.
+	if !created {
+		current := severityLabel(report)
+		var remove []string
+		for _, label := range issue.Labels {
+			if current != "" && strings.HasPrefix(label, severityLabelPrefix) && label != current {
+				remove = append(remove, label)
+			}
+		}
+		if err := x.gitlab.UpdateLabels(ctx, issue, reportLabels(report), remove); err != nil {
+			return nil, err
+		}
+	}
+
+	if issue.IsClosed() && report.Result.Severity != ar.SevSafe {
+		if err := x.gitlab.Reopen(ctx, issue); err != nil {
+			return nil, err
+		}
+		if _, err := x.gitlab.AddNote(ctx, issue, BuildReopenComment(report)); err != nil {
+			return nil, err
+		}
+	}
+
+	body := BuildPublishedReportHeader(report) + BuildCommentBody(report, x.SectionOrder)
+	if _, err := x.gitlab.AddNote(ctx, issue, body); err != nil {
+		return nil, err
+	}
+
+	return x.result(sinkComment, issue), nil
+}
+
+func (x *GitLabSink) Resolve(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	if cache.GitLabIID == 0 {
+		return nil, nil
+	}
+
+	issue, err := x.gitlab.GetIssue(ctx, cache.GitLabProjectID, cache.GitLabIID)
+	if IsGitLabNotFound(err) {
+		// Nothing to close.
+		log.WithField("issue", cache.GitLabURL).Warn("GitLab issue is not found")
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !issue.IsClosed() {
+		if err := x.gitlab.Close(ctx, issue); err != nil {
+			return nil, err
+		}
+	}
+
+	return x.result(sinkResolve, issue), nil
+}
@@ -0,0 +1,187 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	main "github.com/m-mizutani/GithubEmitter"
+)
+
+// fakeGitLab is a minimal GitLab issue API on memory. The project has ID 7
+// and path "blue/five".
+type fakeGitLab struct {
+	fakeServer
+	issues map[string]map[string]interface{}
+	notes  map[string][]string
+}
+
+func newFakeGitLab() *fakeGitLab {
+	x := &fakeGitLab{
+		issues: map[string]map[string]interface{}{},
+		notes:  map[string][]string{},
+	}
+	x.start(x.handle)
+	return x
+}
+
+func (x *fakeGitLab) issue(iid int64) map[string]interface{} {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return x.issues[fmt.Sprint(iid)]
+}
+
+func splitLabels(v interface{}) []string {
+	s, _ := v.(string)
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func (x *fakeGitLab) handle(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("PRIVATE-TOKEN") != "xxx" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"message":"401 Unauthorized"}`))
+		return
+	}
+
+	var req map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	path := r.URL.EscapedPath()
+	switch {
+	case r.Method == "POST" && path == "/api/v4/projects/blue%2Ffive/issues":
+		iid := len(x.issues) + 1
+		issue := map[string]interface{}{
+			"id":          100 + iid,
+			"iid":         iid,
+			"project_id":  7,
+			"title":       req["title"],
+			"description": req["description"],
+			"state":       "opened",
+			"web_url":     fmt.Sprintf("%s/blue/five/-/issues/%d", x.server.URL, iid),
+			"labels":      splitLabels(req["labels"]),
+		}
+		x.issues[fmt.Sprint(iid)] = issue
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(issue)
+		return
+	case !strings.HasPrefix(path, "/api/v4/projects/7/issues/"):
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path, "/api/v4/projects/7/issues/"), "/")
+	issue, ok := x.issues[parts[0]]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message":"404 Not found"}`))
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && parts[1] == "notes":
+		x.notes[parts[0]] = append(x.notes[parts[0]], req["body"].(string))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": len(x.notes[parts[0]])})
+		return
+	case r.Method == "PUT":
+		if v, ok := req["description"]; ok {
+			issue["description"] = v
+		}
+		switch req["state_event"] {
+		case "close":
+			issue["state"] = "closed"
+		case "reopen":
+			issue["state"] = "opened"
+		}
+		labels := []string{}
+		for _, label := range issue["labels"].([]string) {
+			removed := false
+			for _, r := range splitLabels(req["remove_labels"]) {
+				removed = removed || r == label
+			}
+			if !removed {
+				labels = append(labels, label)
+			}
+		}
+		for _, label := range splitLabels(req["add_labels"]) {
+			found := false
+			for _, l := range labels {
+				found = found || l == label
+			}
+			if !found {
+				labels = append(labels, label)
+			}
+		}
+		issue["labels"] = labels
+	}
+	json.NewEncoder(w).Encode(issue)
+}
+
+func TestGitLabSink(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeGitLab()
+	defer fake.Close()
+
+	sink := main.NewGitLabSink(main.NewGitLab(fake.server.URL+"/api/v4", "blue/five", "xxx"))
+
+	report := genDummyReport()
+	report.Result.Severity = ar.SevUnclassified
+	cache := main.ReportCache{ReportID: report.ID}
+	res, err := sink.Create(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), cache.GitLabProjectID)
+	assert.Equal(t, int64(1), cache.GitLabIID)
+	assert.Equal(t, fake.server.URL+"/blue/five/-/issues/1", cache.GitLabURL)
+	assert.Equal(t, fake.server.URL+"/api/v4/projects/7/issues/1", res.ApiURL)
+	assert.Contains(t, fake.issue(1)["labels"], "severity:unclassified")
+
+	_, err = sink.Update(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Contains(t, fake.issue(1)["description"], "\n\n- - - - - - - - - -\n\n## Overview")
+
+	report.Status = ar.StatusPublished
+	report.Result.Severity = ar.SevSafe
+	_, err = sink.Comment(ctx, report, &cache)
+	require.NoError(t, err)
+	_, err = sink.Resolve(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Equal(t, "closed", fake.issue(1)["state"])
+
+	// Escalation reopens the issue and swaps the severity label.
+	report.Result.Severity = ar.SevUrgent
+	_, err = sink.Comment(ctx, report, &cache)
+	require.NoError(t, err)
+	issue := fake.issue(1)
+	assert.Equal(t, "opened", issue["state"])
+	assert.Contains(t, issue["labels"], "severity:urgent")
+	assert.NotContains(t, issue["labels"], "severity:safe")
+	require.Equal(t, 3, len(fake.notes["1"]))
+	assert.Contains(t, fake.notes["1"][1], "Reopened")
+
+	// Deleted issue is created again.
+	cache.GitLabIID = 99
+	_, err = sink.Update(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), cache.GitLabIID)
+}
+
+func TestGitLabAPIError(t *testing.T) {
+	fake := newFakeGitLab()
+	defer fake.Close()
+
+	gitlab := main.NewGitLab(fake.server.URL+"/api/v4", "blue/five", "bad")
+	_, err := gitlab.GetIssue(context.Background(), 7, 1)
+	require.Error(t, err)
+	assert.False(t, main.IsGitLabNotFound(err))
+	assert.Contains(t, err.Error(), "401 Unauthorized")
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultJiraTimeout   = 30 * time.Second
+	defaultJiraIssueType = "Task"
+
+	// Jira rejects summary longer than 255 characters.
+	maxJiraSummary = 255
+)
+
+// JiraAPIError is an error response of Jira REST API.
+type JiraAPIError struct {
+	StatusCode    int               `json:"-"`
+	ErrorMessages []string          `json:"errorMessages"`
+	Errors        map[string]string `json:"errors"`
+}
+
+func (x *JiraAPIError) Error() string {
+	msgs := append([]string{}, x.ErrorMessages...)
+	for field, msg := range x.Errors {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", field, msg))
+	}
+	return fmt.Sprintf("Jira API error (%d): %s", x.StatusCode, strings.Join(msgs, ", "))
+}
+
+// IsJiraNotFound returns true if the error means that the issue does not
+// exist or the user can not see it.
+func IsJiraNotFound(err error) bool {
+	apiErr, ok := errors.Cause(err).(*JiraAPIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// JiraIssue is an issue of Jira. Description is in Jira wiki markup.
+type JiraIssue struct {
+	ID     string `json:"id"`
+	Key    string `json:"key"`
+	Self   string `json:"self"`
+	Fields struct {
+		Description string `json:"description"`
+		Status      struct {
+			Name     string `json:"name"`
+			Category struct {
+				Key string `json:"key"`
+			} `json:"statusCategory"`
+		} `json:"status"`
+	} `json:"fields"`
+}
+
+// IsDone returns true if the issue is in a status of done category.
+func (x *JiraIssue) IsDone() bool {
+	return x.Fields.Status.Category.Key == "done"
+}
+
+// JiraIssueRequest is parameters to create a new issue. Empty Priority means
+// the default priority of the project.
+type JiraIssueRequest struct {
+	Summary     string
+	Description string
+	Priority    string
+}
+
+// Jira is an accessor of Jira REST API v2 for a project. Jira Cloud requires
+// user (e-mail) and API token, and Jira Server accepts a personal access
+// token without user.
+type Jira struct {
+	endpoint  string
+	project   string
+	issueType string
+	user      string
+	token     string
+	client    *http.Client
+}
+
+// JiraOption is an optional setting of Jira accessor.
+type JiraOption func(x *Jira)
+
+// WithJiraIssueType sets issue type of new issues. It's "Task" by default.
+func WithJiraIssueType(issueType string) JiraOption {
+	return func(x *Jira) {
+		x.issueType = issueType
+	}
+}
+
+// WithJiraUser sets user for basic authentication with the token.
+func WithJiraUser(user string) JiraOption {
+	return func(x *Jira) {
+		x.user = user
+	}
+}
+
+// NewJira returns a Jira accessor. endpoint is base URL of Jira, e.g.
+// https://example.atlassian.net
+func NewJira(endpoint, project, token string, options ...JiraOption) *Jira {
+	x := &Jira{
+		endpoint:  strings.TrimRight(endpoint, "/"),
+		project:   project,
+		issueType: defaultJiraIssueType,
+		token:     token,
+		client:    &http.Client{Timeout: defaultJiraTimeout},
+	}
+	for _, opt := range options {
+		opt(x)
+	}
+	return x
+}
+
+// BrowseURL returns URL of the issue for browser.
+func (x *Jira) BrowseURL(key string) string {
+	return fmt.Sprintf("%s/browse/%s", x.endpoint, key)
+}
+
+// request sends a request to Jira REST API. The response is parsed into
+// result if it's not nil. A status other than 2xx is returned as
+// *JiraAPIError.
+func (x *Jira) request(ctx context.Context, method, path string, data, result interface{}) error {
+	var body []byte
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return errors.Wrap(err, "Fail to marshal Jira request")
+		}
+		body = raw
+	}
+
+	req, err := http.NewRequest(method, x.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "Fail to create Jira request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if x.user != "" {
+		req.SetBasicAuth(x.user, x.token)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+x.token)
+	}
+
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Fail to send Jira request")
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "Fail to read Jira response")
+	}
+
+	if resp.StatusCode < 200 || 300 <= resp.StatusCode {
+		apiErr := &JiraAPIError{StatusCode: resp.StatusCode}
+		if err := json.Unmarshal(raw, apiErr); err != nil {
+			apiErr.ErrorMessages = []string{strings.TrimSpace(string(raw))}
+		}
+		return apiErr
+	}
+
+	if result != nil {
+		if err := json.Unmarshal(raw, result); err != nil {
+			return errors.Wrap(err, "Fail to parse Jira response")
+		}
+	}
+	return nil
+}
+
+// CreateIssue creates a new issue in the project.
+func (x *Jira) CreateIssue(ctx context.Context, issueReq JiraIssueRequest) (*JiraIssue, error) {
+	summary := []rune(issueReq.Summary)
+	if len(summary) > maxJiraSummary {
+		summary = summary[:maxJiraSummary]
+	}
+
+	fields := map[string]interface{}{
+		"project":     map[string]string{"key": x.project},
+		"issuetype":   map[string]string{"name": x.issueType},
+		"summary":     string(summary),
+		"description": issueReq.Description,
+	}
+	if issueReq.Priority != "" {
+		fields["priority"] = map[string]string{"name": issueReq.Priority}
+	}
+
+	var issue JiraIssue
+	data := map[string]interface{}{"fields": fields}
+	if err := x.request(ctx, "POST", "/rest/api/2/issue", data, &issue); err != nil {
+		return nil, errors.Wrap(err, "Fail to create a Jira issue")
+	}
+	issue.Fields.Description = issueReq.Description
+	return &issue, nil
+}
+
+// GetIssue returns the issue by key, e.g. "SEC-123".
+func (x *Jira) GetIssue(ctx context.Context, key string) (*JiraIssue, error) {
+	var issue JiraIssue
+	path := fmt.Sprintf("/rest/api/2/issue/%s?fields=description,status", url.PathEscape(key))
+	if err := x.request(ctx, "GET", path, nil, &issue); err != nil {
+		return nil, errors.Wrap(err, "Fail to get a Jira issue")
+	}
+	return &issue, nil
+}
+
+// SearchIssues returns issues in the project matched with the text in
+// description, in order of creation.
+func (x *Jira) SearchIssues(ctx context.Context, text string) ([]*JiraIssue, error) {
+	jql := fmt.Sprintf(`project = "%s" AND description ~ "\"%s\"" ORDER BY created ASC`, x.project, text)
+	path := fmt.Sprintf("/rest/api/2/search?fields=description,status&jql=%s", url.QueryEscape(jql))
+
+	var result struct {
+		Issues []*JiraIssue `json:"issues"`
+	}
+	if err := x.request(ctx, "GET", path, nil, &result); err != nil {
+		return nil, errors.Wrap(err, "Fail to search Jira issues")
+	}
+	return result.Issues, nil
+}
+
+// AppendDescription appends content to description of the issue.
+func (x *Jira) AppendDescription(ctx context.Context, issue *JiraIssue, content string) error {
+	desc := fmt.Sprintf("%s\n\n----\n\n%s", issue.Fields.Description, content)
+	data := map[string]interface{}{
+		"fields": map[string]interface{}{"description": desc},
+	}
+	path := fmt.Sprintf("/rest/api/2/issue/%s", url.PathEscape(issue.Key))
+	if err := x.request(ctx, "PUT", path, data, nil); err != nil {
+		return errors.Wrap(err, "Fail to update description of Jira issue")
+	}
+	issue.Fields.Description = desc
+	return nil
+}
+
+// SetPriority changes priority of the issue.
+func (x *Jira) SetPriority(ctx context.Context, key, priority string) error {
+	data := map[string]interface{}{
+		"fields": map[string]interface{}{
+			"priority": map[string]string{"name": priority},
+		},
+	}
+	path := fmt.Sprintf("/rest/api/2/issue/%s", url.PathEscape(key))
+	if err := x.request(ctx, "PUT", path, data, nil); err != nil {
+		return errors.Wrap(err, "Fail to set priority of Jira issue")
+	}
+	return nil
+}
+
+// AddComment posts a comment to the issue and returns URL of the comment.
+func (x *Jira) AddComment(ctx context.Context, key, body string) (string, error) {
+	var comment struct {
+		Self string `json:"self"`
+	}
+	path := fmt.Sprintf("/rest/api/2/issue/%s/comment", url.PathEscape(key))
+	if err := x.request(ctx, "POST", path, map[string]string{"body": body}, &comment); err != nil {
+		return "", errors.Wrap(err, "Fail to add a comment to Jira issue")
+	}
+	return comment.Self, nil
+}
+
+// Transition moves the issue to the status by a transition available now.
+// A transition is chosen by name of itself or the destination status, and
+// the first one to done category is used if no name matches.
+func (x *Jira) Transition(ctx context.Context, key, status string) error {
+	var result struct {
+		Transitions []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+			To   struct {
+				Name     string `json:"name"`
+				Category struct {
+					Key string `json:"key"`
+				} `json:"statusCategory"`
+			} `json:"to"`
+		} `json:"transitions"`
+	}
+
+	path := fmt.Sprintf("/rest/api/2/issue/%s/transitions", url.PathEscape(key))
+	if err := x.request(ctx, "GET", path, nil, &result); err != nil {
+		return errors.Wrap(err, "Fail to get transitions of Jira issue")
+	}
+
+	id := ""
+	for _, t := range result.Transitions {
+		if strings.EqualFold(t.Name, status) || strings.EqualFold(t.To.Name, status) {
+			id = t.ID
+			break
+		}
+	}
+	if id == "" {
+		for _, t := range result.Transitions {
+			if t.To.Category.Key == "done" {
+				id = t.ID
+				break
+			}
+		}
+	}
+	if id == "" {
+		return fmt.Errorf("No transition to %s for Jira issue %s", status, key)
+	}
+
+	data := map[string]interface{}{
+		"transition": map[string]string{"id": id},
+	}
+	if err := x.request(ctx, "POST", path, data, nil); err != nil {
+		return errors.Wrap(err, "Fail to transition Jira issue")
+	}
+	return nil
+}
+
+const jiraSinkName = "jira"
+
+// defaultJiraPriorities maps severity of a report to Jira priority.
+var defaultJiraPriorities = map[string]string{
+	string(ar.SevUrgent):       "Highest",
+	string(ar.SevUnclassified): "Medium",
+	string(ar.SevSafe):         "Low",
+}
+
+// JiraSink publishes a report as a Jira issue in the same way as GitHubSink.
+// Description and comments are converted into Jira wiki markup, and a safe
+// report transitions the issue to Done.
+type JiraSink struct {
+	jira       *Jira
+	priorities map[string]string
+
+	// SectionOrder sorts sections of published reports.
+	SectionOrder SectionOrder
+}
+
+// NewJiraSink returns a sink for Jira. priorities overrides the default
+// mapping from severity to priority name.
+func NewJiraSink(jira *Jira, priorities map[string]string) *JiraSink {
+	x := &JiraSink{jira: jira, priorities: map[string]string{}}
+	for k, v := range defaultJiraPriorities {
+		x.priorities[k] = v
+	}
+	for k, v := range priorities {
+		x.priorities[k] = v
+	}
+	return x
+}
+
+func (x *JiraSink) Name() string { return jiraSinkName }
+
+func (x *JiraSink) newIssue(ctx context.Context, report ar.Report, cache *ReportCache) (*JiraIssue, error) {
+	desc := reportIDMarker(report.ID) + "\n\n" + MarkdownToJiraWiki(BuildIssueBody(report))
+	issue, err := x.jira.CreateIssue(ctx, JiraIssueRequest{
+		Summary:     report.Alert.Title(),
+		Description: desc,
+		Priority:    x.priorities[string(report.Result.Severity)],
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cache.JiraKey = issue.Key
+	cache.JiraURL = x.jira.BrowseURL(issue.Key)
+	return issue, nil
+}
+
+// getIssue returns the issue of the report, or creates a new issue if it has
+// been deleted and returns created as true.
+func (x *JiraSink) getIssue(ctx context.Context, report ar.Report, cache *ReportCache) (issue *JiraIssue, created bool, err error) {
+	if cache.JiraKey != "" {
+		issue, err = x.jira.GetIssue(ctx, cache.JiraKey)
+		if err == nil {
+			return issue, false, nil
+		} else if !IsJiraNotFound(err) {
+			return nil, false, err
+		}
+		log.WithError(err).WithField("issue", cache.JiraKey).
+			Warn("Jira issue is not found, then create a new one")
+	}
+
+	issue, err = x.newIssue(ctx, report, cache)
+	return issue, true, err
+}
+
+func (x *JiraSink) Create(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	issue, err := x.newIssue(ctx, report, cache)
+	if err != nil {
+		return nil, err
+	}
+	return &SinkResult{Sink: x.Name(), Action: sinkCreate, ApiURL: issue.Self, HtmlURL: cache.JiraURL}, nil
+}
+
+// Recover searches the issue by the ReportID marker in description.
+func (x *JiraSink) Recover(ctx context.Context, report ar.Report, cache *ReportCache) (bool, error) {
+	marker := reportIDMarker(report.ID)
+	issues, err := x.jira.SearchIssues(ctx, marker)
+	if err != nil {
+		return false, err
+	}
+
+	for _, issue := range issues {
+		firstLine := strings.SplitN(issue.Fields.Description, "\n", 2)[0]
+		if strings.TrimSpace(firstLine) != marker {
+			continue
+		}
+
+		cache.JiraKey = issue.Key
+		cache.JiraURL = x.jira.BrowseURL(issue.Key)
+		return true, nil
+	}
+
+	return false, nil
+}
+
+func (x *JiraSink) Update(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	issue, created, err := x.getIssue(ctx, report, cache)
+	if err != nil {
+		return nil, err
+	}
+
+	if !created {
+		if err := x.jira.AppendDescription(ctx, issue, MarkdownToJiraWiki(BuildIssueBody(report))); err != nil {
+			return nil, err
+		}
+	}
+
+	return &SinkResult{Sink: x.Name(), Action: sinkUpdate, ApiURL: issue.Self, HtmlURL: cache.JiraURL}, nil
+}
+
+func (x *JiraSink) Comment(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	issue, created, err := x.getIssue(ctx, report, cache)
+	if err != nil {
+		return nil, err
+	}
+
+	// Severity is decided by publishing.
+	if priority := x.priorities[string(report.Result.Severity)]; priority != "" && !created {
+		if err := x.jira.SetPriority(ctx, issue.Key, priority); err != nil {
+			return nil, err
+		}
+	}
+
+	body := MarkdownToJiraWiki(BuildPublishedReportHeader(report) + BuildCommentBody(report, x.SectionOrder))
+	commentURL, err := x.jira.AddComment(ctx, issue.Key, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SinkResult{Sink: x.Name(), Action: sinkComment, ApiURL: commentURL, HtmlURL: cache.JiraURL}, nil
+}
+
+func (x *JiraSink) Resolve(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	if cache.JiraKey == "" {
+		return nil, nil
+	}
+
+	issue, err := x.jira.GetIssue(ctx, cache.JiraKey)
+	if IsJiraNotFound(err) {
+		// Nothing to close.
+		log.WithField("issue", cache.JiraKey).Warn("Jira issue is not found")
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !issue.IsDone() {
+		if err := x.jira.Transition(ctx, issue.Key, "Done"); err != nil {
+			return nil, err
+		}
+	}
+
+	return &SinkResult{Sink: x.Name(), Action: sinkResolve, ApiURL: issue.Self, HtmlURL: cache.JiraURL}, nil
+}
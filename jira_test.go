@@ -0,0 +1,140 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	main "github.com/m-mizutani/GithubEmitter"
+)
+
+// fakeJira is a minimal Jira REST API v2 on memory.
+type fakeJira struct {
+	fakeServer
+	seq      int
+	issues   map[string]map[string]interface{}
+	comments map[string][]string
+}
+
+func newFakeJira() *fakeJira {
+	x := &fakeJira{
+		issues:   map[string]map[string]interface{}{},
+		comments: map[string][]string{},
+	}
+	x.start(x.handle)
+	return x
+}
+
+func (x *fakeJira) fields(key string) map[string]interface{} {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return x.issues[key]
+}
+
+func (x *fakeJira) handle(w http.ResponseWriter, r *http.Request) {
+	var req map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&req)
+	path := strings.TrimPrefix(r.URL.Path, "/rest/api/2/issue")
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+
+	if r.Method == "POST" && path == "" {
+		x.seq++
+		key := fmt.Sprintf("SEC-%d", x.seq)
+		fields := req["fields"].(map[string]interface{})
+		fields["status"] = map[string]interface{}{
+			"name": "To Do", "statusCategory": map[string]string{"key": "new"},
+		}
+		x.issues[key] = fields
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{
+			"id": fmt.Sprint(x.seq), "key": key, "self": x.server.URL + "/rest/api/2/issue/" + key,
+		})
+		return
+	}
+
+	fields, ok := x.issues[parts[0]]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errorMessages":["Issue does not exist or you do not have permission to see it."],"errors":{}}`))
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		json.NewEncoder(w).Encode(map[string]interface{}{"key": parts[0], "fields": fields})
+	case len(parts) == 1 && r.Method == "PUT":
+		for k, v := range req["fields"].(map[string]interface{}) {
+			fields[k] = v
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case parts[1] == "comment":
+		x.comments[parts[0]] = append(x.comments[parts[0]], req["body"].(string))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"self": x.server.URL + r.URL.Path + "/1"})
+	case parts[1] == "transitions" && r.Method == "GET":
+		w.Write([]byte(`{"transitions":[
+			{"id":"11","name":"Start","to":{"name":"In Progress","statusCategory":{"key":"indeterminate"}}},
+			{"id":"31","name":"Close","to":{"name":"Done","statusCategory":{"key":"done"}}}]}`))
+	case parts[1] == "transitions" && r.Method == "POST":
+		if req["transition"].(map[string]interface{})["id"] == "31" {
+			fields["status"] = map[string]interface{}{
+				"name": "Done", "statusCategory": map[string]string{"key": "done"},
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func TestJiraSink(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeJira()
+	defer fake.Close()
+
+	jira := main.NewJira(fake.server.URL, "SEC", "xxx", main.WithJiraUser("blue@example.com"))
+	sink := main.NewJiraSink(jira, map[string]string{"urgent": "P1"})
+
+	report := genDummyReport()
+	cache := main.ReportCache{ReportID: report.ID}
+	_, err := sink.Create(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Equal(t, "SEC-1", cache.JiraKey)
+	assert.Equal(t, fake.server.URL+"/browse/SEC-1", cache.JiraURL)
+
+	fields := fake.fields(cache.JiraKey)
+	assert.Equal(t, report.Alert.Title(), fields["summary"])
+	assert.Equal(t, map[string]interface{}{"name": "Task"}, fields["issuetype"])
+	assert.Contains(t, fields["description"], "ReportID: "+string(report.ID)+"\n\nh2. Overview")
+
+	_, err = sink.Update(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Contains(t, fake.fields(cache.JiraKey)["description"], "\n\n----\n\nh2. Overview")
+
+	report.Status = ar.StatusPublished
+	report.Result.Severity = ar.SevUrgent
+	res, err := sink.Comment(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Contains(t, res.ApiURL, "/rest/api/2/issue/SEC-1/comment/")
+	assert.Equal(t, map[string]interface{}{"name": "P1"}, fake.fields(cache.JiraKey)["priority"])
+	assert.Contains(t, fake.comments["SEC-1"][0], "*Severity: urgent*")
+
+	report.Result.Severity = ar.SevSafe
+	_, err = sink.Resolve(ctx, report, &cache)
+	require.NoError(t, err)
+	status := fake.fields(cache.JiraKey)["status"].(map[string]interface{})
+	assert.Equal(t, "Done", status["name"])
+
+	// Deleted issue is created again.
+	cache.JiraKey = "SEC-99"
+	_, err = sink.Update(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Equal(t, "SEC-2", cache.JiraKey)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+)
+
+const (
+	severityLabelPrefix = "severity:"
+	ruleLabelPrefix     = "rule:"
+	attrLabelPrefix     = "attr:"
+
+	// GitHub rejects a label name longer than 50 characters.
+	maxLabelLength = 50
+)
+
+func labelName(prefix, value string) string {
+	name := []rune(prefix + strings.TrimSpace(value))
+	if len(name) > maxLabelLength {
+		name = name[:maxLabelLength]
+	}
+	return string(name)
+}
+
+// severityLabel returns a label of the report severity. It returns an empty
+// string if the report is not classified yet.
+func severityLabel(report ar.Report) string {
+	if report.Result.Severity == "" {
+		return ""
+	}
+	return labelName(severityLabelPrefix, string(report.Result.Severity))
+}
+
+// reportLabels returns labels of the report: severity, detection rule and
+// types of alert attributes. Attribute labels are sorted and unique.
+func reportLabels(report ar.Report) []string {
+	var labels []string
+	if sev := severityLabel(report); sev != "" {
+		labels = append(labels, sev)
+	}
+	if report.Alert.Rule != "" {
+		labels = append(labels, labelName(ruleLabelPrefix, report.Alert.Rule))
+	}
+
+	attrTypes := map[string]bool{}
+	for _, attr := range report.Alert.Attrs {
+		if attr.Type != "" {
+			attrTypes[labelName(attrLabelPrefix, attr.Type)] = true
+		}
+	}
+	attrLabels := []string{}
+	for label := range attrTypes {
+		attrLabels = append(attrLabels, label)
+	}
+	sort.Strings(attrLabels)
+
+	return append(labels, attrLabels...)
+}
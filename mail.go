@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+)
+
+const defaultMailTimeout = 30 * time.Second
+
+// MailMessage is a mail of a report. Text is Markdown that is sent as the
+// plaintext part and rendered into the HTML part. InReplyTo makes the mail a
+// reply in the thread of the message.
+type MailMessage struct {
+	Subject   string
+	Text      string
+	MessageID string
+	InReplyTo string
+}
+
+// Mailer sends mails to recipients via a SMTP server. STARTTLS is used if the
+// server supports it.
+type Mailer struct {
+	addr    string
+	from    string
+	to      []string
+	domain  string
+	auth    smtp.Auth
+	timeout time.Duration
+}
+
+// MailerOption is an optional setting of Mailer.
+type MailerOption func(x *Mailer)
+
+// WithMailAuth enables PLAIN authentication. net/smtp refuses it without TLS
+// except for localhost.
+func WithMailAuth(user, password string) MailerOption {
+	return func(x *Mailer) {
+		host, _, _ := net.SplitHostPort(x.addr)
+		x.auth = smtp.PlainAuth("", user, password, host)
+	}
+}
+
+// NewMailer returns a Mailer. addr is host and port of the SMTP server, e.g.
+// smtp.example.com:587, and from is an address like "Reporter
+// <alert@example.com>".
+func NewMailer(addr, from string, to []string, options ...MailerOption) (*Mailer, error) {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid mail from address: %s", from)
+	}
+	for _, rcpt := range to {
+		if _, err := mail.ParseAddress(rcpt); err != nil {
+			return nil, errors.Wrapf(err, "Invalid mail to address: %s", rcpt)
+		}
+	}
+
+	x := &Mailer{
+		addr:    addr,
+		from:    from,
+		to:      to,
+		domain:  sender.Address[strings.LastIndex(sender.Address, "@")+1:],
+		timeout: defaultMailTimeout,
+	}
+	for _, opt := range options {
+		opt(x)
+	}
+	return x, nil
+}
+
+// ThreadID returns Message-ID of the first mail of the report. Follow-up
+// mails refer it by In-Reply-To, then they are threaded even if the cache is
+// lost.
+func (x *Mailer) ThreadID(reportID ar.ReportID) string {
+	return fmt.Sprintf("<report.%s@%s>", reportID, x.domain)
+}
+
+// FollowUpID returns a new Message-ID of a follow-up mail of the report.
+func (x *Mailer) FollowUpID(reportID ar.ReportID, now time.Time) string {
+	return fmt.Sprintf("<report.%s.%d@%s>", reportID, now.UnixNano(), x.domain)
+}
+
+func writeMailPart(w *multipart.Writer, contentType, content string) error {
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType+"; charset=utf-8")
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(part)
+	if _, err := qp.Write([]byte(content)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// htmlMail wraps a HTML fragment into a document.
+func htmlMail(fragment string) string {
+	return "<!DOCTYPE html>\n<html>\n<head><meta charset=\"utf-8\"></head>\n<body>\n" +
+		fragment + "\n</body>\n</html>\n"
+}
+
+// Build creates a multipart/alternative mail of the message with plaintext
+// and HTML parts.
+func (x *Mailer) Build(msg MailMessage, now time.Time) ([]byte, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if err := writeMailPart(w, "text/plain", msg.Text); err != nil {
+		return nil, errors.Wrap(err, "Fail to write plaintext part of mail")
+	}
+	if err := writeMailPart(w, "text/html", htmlMail(MarkdownToHTML(msg.Text))); err != nil {
+		return nil, errors.Wrap(err, "Fail to write HTML part of mail")
+	}
+	if err := w.Close(); err != nil {
+		return nil, errors.Wrap(err, "Fail to close mail body")
+	}
+
+	headers := [][2]string{
+		{"From", x.from},
+		{"To", strings.Join(x.to, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", msg.Subject)},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"Message-ID", msg.MessageID},
+	}
+	if msg.InReplyTo != "" {
+		headers = append(headers, [2]string{"In-Reply-To", msg.InReplyTo})
+		headers = append(headers, [2]string{"References", msg.InReplyTo})
+	}
+	headers = append(headers,
+		[2]string{"MIME-Version", "1.0"},
+		[2]string{"Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", w.Boundary())},
+	)
+
+	var raw bytes.Buffer
+	for _, h := range headers {
+		fmt.Fprintf(&raw, "%s: %s\r\n", h[0], h[1])
+	}
+	raw.WriteString("\r\n")
+	raw.Write(body.Bytes())
+	return raw.Bytes(), nil
+}
+
+// Send sends the message to all recipients.
+func (x *Mailer) Send(ctx context.Context, msg MailMessage) error {
+	raw, err := x.Build(msg, time.Now())
+	if err != nil {
+		return err
+	}
+
+	dialer := net.Dialer{Timeout: x.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", x.addr)
+	if err != nil {
+		return errors.Wrapf(err, "Fail to connect SMTP server %s", x.addr)
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(x.timeout)
+	}
+	conn.SetDeadline(deadline)
+
+	host, _, _ := net.SplitHostPort(x.addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "Fail to start SMTP session")
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return errors.Wrap(err, "Fail to start TLS with SMTP server")
+		}
+	}
+	if x.auth != nil {
+		if err := client.Auth(x.auth); err != nil {
+			return errors.Wrap(err, "Fail to authenticate with SMTP server")
+		}
+	}
+
+	sender, _ := mail.ParseAddress(x.from)
+	if err := client.Mail(sender.Address); err != nil {
+		return errors.Wrap(err, "Fail to set mail sender")
+	}
+	for _, to := range x.to {
+		rcpt, _ := mail.ParseAddress(to)
+		if err := client.Rcpt(rcpt.Address); err != nil {
+			return errors.Wrapf(err, "Fail to set mail recipient %s", rcpt.Address)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return errors.Wrap(err, "Fail to start mail data")
+	}
+	if _, err := w.Write(raw); err != nil {
+		return errors.Wrap(err, "Fail to write mail data")
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrap(err, "Fail to send mail")
+	}
+
+	return client.Quit()
+}
+
+const mailSinkName = "mail"
+
+// MailSink sends a report by mail. Mails of a report are threaded by
+// Message-ID derived from ReportID, then the sink keeps no state in the cache.
+type MailSink struct {
+	mailer *Mailer
+
+	// SectionOrder sorts sections of published reports.
+	SectionOrder SectionOrder
+}
+
+// NewMailSink returns a sink to send mails by the mailer.
+func NewMailSink(mailer *Mailer) *MailSink {
+	return &MailSink{mailer: mailer}
+}
+
+func (x *MailSink) Name() string { return mailSinkName }
+
+func (x *MailSink) Create(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	msg := MailMessage{
+		Subject:   report.Alert.Title(),
+		Text:      BuildIssueBody(report),
+		MessageID: x.mailer.ThreadID(report.ID),
+	}
+	if err := x.mailer.Send(ctx, msg); err != nil {
+		return nil, errors.Wrap(err, "Fail to send a report by mail")
+	}
+	return &SinkResult{Sink: x.Name(), Action: sinkCreate}, nil
+}
+
+// reply sends a follow-up mail in the thread of the report.
+func (x *MailSink) reply(ctx context.Context, report ar.Report, text string) error {
+	msg := MailMessage{
+		Subject:   "Re: " + report.Alert.Title(),
+		Text:      text,
+		MessageID: x.mailer.FollowUpID(report.ID, time.Now()),
+		InReplyTo: x.mailer.ThreadID(report.ID),
+	}
+	if err := x.mailer.Send(ctx, msg); err != nil {
+		return errors.Wrap(err, "Fail to send a follow-up mail")
+	}
+	return nil
+}
+
+func (x *MailSink) Update(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	if err := x.reply(ctx, report, BuildIssueBody(report)); err != nil {
+		return nil, err
+	}
+	return &SinkResult{Sink: x.Name(), Action: sinkUpdate}, nil
+}
+
+func (x *MailSink) Comment(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	body := BuildPublishedReportHeader(report) + BuildCommentBody(report, x.SectionOrder)
+	if err := x.reply(ctx, report, body); err != nil {
+		return nil, err
+	}
+	return &SinkResult{Sink: x.Name(), Action: sinkComment}, nil
+}
+
+// Resolve does nothing because the published report was already sent by
+// Comment.
+func (x *MailSink) Resolve(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	return nil, nil
+}
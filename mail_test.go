@@ -0,0 +1,196 @@
+package main_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	main "github.com/m-mizutani/GithubEmitter"
+)
+
+type smtpMail struct {
+	from string
+	to   []string
+	data []byte
+}
+
+// fakeSMTP is a minimal SMTP server that records received mails.
+type fakeSMTP struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	mails    []smtpMail
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	x := &fakeSMTP{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go x.serve(conn)
+		}
+	}()
+	return x
+}
+
+func (x *fakeSMTP) serve(conn net.Conn) {
+	tp := textproto.NewConn(conn)
+	defer tp.Close()
+
+	var m smtpMail
+	tp.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+
+		switch cmd {
+		case "EHLO":
+			tp.PrintfLine("250 localhost")
+		case "MAIL":
+			m = smtpMail{from: strings.TrimPrefix(line, "MAIL FROM:")}
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			m.to = append(m.to, strings.TrimPrefix(line, "RCPT TO:"))
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			m.data = data
+			x.mutex.Lock()
+			x.mails = append(x.mails, m)
+			x.mutex.Unlock()
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+func (x *fakeSMTP) Close() { x.listener.Close() }
+
+func (x *fakeSMTP) received() []smtpMail {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return append([]smtpMail{}, x.mails...)
+}
+
+// parseMail returns the header and parts (by content type) of the mail.
+func parseMail(t *testing.T, data []byte) (mail.Header, map[string]string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/alternative", mediaType)
+
+	parts := map[string]string{}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		// multipart.Reader decodes quoted-printable transparently.
+		raw, err := ioutil.ReadAll(part)
+		require.NoError(t, err)
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		parts[contentType] = string(raw)
+	}
+	return msg.Header, parts
+}
+
+func TestMailSink(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeSMTP(t)
+	defer fake.Close()
+
+	mailer, err := main.NewMailer(fake.listener.Addr().String(), "Reporter <alert@example.com>",
+		[]string{"soc@example.com", "Blue <blue@example.com>"})
+	require.NoError(t, err)
+	sink := main.NewMailSink(mailer)
+
+	report := genDummyReport()
+	cache := main.ReportCache{ReportID: report.ID}
+	_, err = sink.Create(ctx, report, &cache)
+	require.NoError(t, err)
+
+	report.Status = ar.StatusPublished
+	report.Result.Severity = ar.SevUrgent
+	res, err := sink.Comment(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Equal(t, "comment", res.Action)
+
+	mails := fake.received()
+	require.Equal(t, 2, len(mails))
+	root := mails[0]
+	assert.Equal(t, "<alert@example.com>", root.from)
+	assert.Equal(t, []string{"<soc@example.com>", "<blue@example.com>"}, root.to)
+
+	threadID := "<report." + string(report.ID) + "@example.com>"
+	header, parts := parseMail(t, root.data)
+	assert.Equal(t, threadID, header.Get("Message-ID"))
+	assert.Equal(t, "", header.Get("In-Reply-To"))
+	assert.Equal(t, report.Alert.Title(), header.Get("Subject"))
+	assert.Contains(t, parts["text/plain"], "## Overview")
+	assert.Contains(t, parts["text/html"], "<h2>Overview</h2>")
+	assert.Contains(t, parts["text/html"], "<code>10.0.0.1</code>")
+
+	header, parts = parseMail(t, mails[1].data)
+	assert.NotEqual(t, threadID, header.Get("Message-ID"))
+	assert.True(t, strings.HasPrefix(header.Get("Message-ID"), "<report."+string(report.ID)+"."))
+	assert.Equal(t, threadID, header.Get("In-Reply-To"))
+	assert.Equal(t, threadID, header.Get("References"))
+	assert.Equal(t, "Re: "+report.Alert.Title(), header.Get("Subject"))
+	assert.Contains(t, parts["text/plain"], "## Opponent Host: 10.0.0.1")
+	assert.Contains(t, parts["text/html"], "<h2>Opponent Host: 10.0.0.1</h2>")
+	assert.Contains(t, parts["text/html"], "<table>")
+}
+
+func TestMailerBuild(t *testing.T) {
+	mailer, err := main.NewMailer("localhost:25", "alert@example.com", []string{"soc@example.com"})
+	require.NoError(t, err)
+
+	raw, err := mailer.Build(main.MailMessage{
+		Subject:   "警告: <script>",
+		Text:      "- name: `<b>`",
+		MessageID: mailer.ThreadID("r1"),
+	}, time.Now())
+	require.NoError(t, err)
+
+	header, parts := parseMail(t, raw)
+	subject, err := new(mime.WordDecoder).DecodeHeader(header.Get("Subject"))
+	require.NoError(t, err)
+	assert.Equal(t, "警告: <script>", subject)
+	assert.Equal(t, "- name: `<b>`", parts["text/plain"])
+	assert.Contains(t, parts["text/html"], "<li>name: <code>&lt;b&gt;</code>")
+
+	_, err = main.NewMailer("localhost:25", "not an address", nil)
+	assert.Error(t, err)
+}
@@ -1,21 +1,21 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"net/http"
 	"os"
+	"strconv"
+	"time"
 
-	"github.com/guregu/dynamo"
+	"github.com/cenkalti/backoff"
 	ar "github.com/m-mizutani/AlertResponder/lib"
 	"github.com/pkg/errors"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -24,6 +24,58 @@ type secretValues struct {
 	GithubRepository string `json:"github_repo"`
 	GithubToken      string `json:"github_token"`
 	PagerDutyToken   string `json:"pagerduty_token"`
+	// PagerDutyEndpoint replaces URL of PagerDuty Events API v2 (optional).
+	PagerDutyEndpoint string `json:"pagerduty_endpoint"`
+
+	// SlackToken is a bot token to post reports to SlackChannel (optional).
+	SlackToken   string `json:"slack_token"`
+	SlackChannel string `json:"slack_channel"`
+
+	// Jira is used as issue tracker if JiraEndpoint and JiraProject are set.
+	// JiraUser is required for Jira Cloud. JiraPriorities maps severity to
+	// priority name.
+	JiraEndpoint   string            `json:"jira_endpoint"`
+	JiraProject    string            `json:"jira_project"`
+	JiraUser       string            `json:"jira_user"`
+	JiraToken      string            `json:"jira_token"`
+	JiraIssueType  string            `json:"jira_issue_type"`
+	JiraPriorities map[string]string `json:"jira_priorities"`
+
+	// GitLab is used as issue tracker if GitLabEndpoint and GitLabProject
+	// are set. GitLabProject is a numeric ID or a path of the project.
+	GitLabEndpoint string `json:"gitlab_endpoint"`
+	GitLabProject  string `json:"gitlab_project"`
+	GitLabToken    string `json:"gitlab_token"`
+
+	// Teams is used if TeamsAppID and TeamsConversationID are set. The app
+	// is a bot registered in Azure and TeamsServiceURL is the connector URL
+	// of the tenant, e.g. https://smba.trafficmanager.net/apac/
+	TeamsAppID          string `json:"teams_app_id"`
+	TeamsAppPassword    string `json:"teams_app_password"`
+	TeamsServiceURL     string `json:"teams_service_url"`
+	TeamsConversationID string `json:"teams_conversation_id"`
+
+	// Reports are sent by mail to MailTo if SMTPAddr (host:port) is set.
+	// SMTPUser and SMTPPassword are for PLAIN authentication (optional).
+	SMTPAddr     string   `json:"smtp_addr"`
+	SMTPUser     string   `json:"smtp_user"`
+	SMTPPassword string   `json:"smtp_password"`
+	MailFrom     string   `json:"mail_from"`
+	MailTo       []string `json:"mail_to"`
+
+	// Webhooks receive signed envelopes of report events.
+	Webhooks []WebhookConfig `json:"webhooks"`
+
+	// Routes is a routing table of new issues.
+	Routes []RouteRule `json:"routes"`
+	// PagingPolicy decides which reports page on-call by PagerDuty.
+	PagingPolicy *PagingPolicy `json:"paging_policy"`
+}
+
+// WebhookConfig is an endpoint of webhook and the secret to sign requests.
+type WebhookConfig struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
 }
 
 type Result struct {
@@ -31,178 +83,465 @@ type Result struct {
 	HtmlURL        string `json:"html_url"`
 	CommentApiURL  string `json:"comment_api_url"`
 	CommentHtmlURL string `json:"comment_html_url"`
+
+	// Sinks has results of all sinks in order of actions.
+	Sinks []SinkResult `json:"sinks"`
+	// Paging is the decision of paging policy for a published report.
+	Paging *PagingDecision `json:"paging,omitempty"`
 }
 
-type reportCache struct {
-	ReportID ar.ReportID `dynamo:"report_id"`
-	IssueURL string      `dynamo:"issue_url"`
-	HtmlURL  string      `dynamo:"html_url"`
+// Emitter delivers reports to sinks. States of sinks for each report are
+// saved in the store.
+type Emitter struct {
+	store ReportStore
+	sinks []Sink
+	// keys are unique names of sinks to save progress in the cache.
+	keys map[Sink]string
+
+	// ClaimTimeout is max duration to wait for another writer that is
+	// creating an issue of the same report.
+	ClaimTimeout time.Duration
+	// ClaimLease is max duration to hold a claim. Another writer takes over
+	// the claim after it, then it should be longer than the time to create
+	// issues. The deadline of ctx shortens the lease.
+	ClaimLease time.Duration
+	// Retention is lifetime of a cache record since the last access. Zero
+	// means that records never expire.
+	Retention time.Duration
+	// ExpiryPolicy decides how to handle an expired record that remains in
+	// the store.
+	ExpiryPolicy ExpiryPolicy
 }
 
-func CreatePagerDutyIncident(token, title, url string) error {
-	type incidentContext struct {
-		Type string `json:"type"`
-		Href string `json:"href"`
-		Text string `json:"text"`
+// ExpiryPolicy is a behavior for an expired cache record.
+type ExpiryPolicy string
+
+const (
+	// ExpiryNewIssue ignores the expired record and creates a new issue.
+	ExpiryNewIssue ExpiryPolicy = "new_issue"
+	// ExpirySearch looks up the old issue of the report by sinks (e.g.
+	// GitHub search API) and keeps using it if it's found.
+	ExpirySearch ExpiryPolicy = "search"
+)
+
+const (
+	defaultClaimTimeout = 60 * time.Second
+	defaultClaimLease   = 5 * time.Minute
+	defaultRetention    = 90 * 24 * time.Hour
+)
+
+// NewEmitter returns an Emitter with the store and sinks.
+func NewEmitter(store ReportStore, sinks []Sink) *Emitter {
+	// Sinks of the same kind (e.g. webhooks) are numbered in order.
+	keys := map[Sink]string{}
+	count := map[string]int{}
+	for _, sink := range sinks {
+		name := sink.Name()
+		count[name]++
+		if count[name] > 1 {
+			name = fmt.Sprintf("%s#%d", name, count[name])
+		}
+		keys[sink] = name
 	}
-	type incidentBody struct {
-		ServiceKey  string            `json:"service_key"`
-		EventType   string            `json:"event_type"`
-		Description string            `json:"description"`
-		Detail      string            `json:"detail"`
-		Client      string            `json:"client"`
-		ClientURL   string            `json:"client_url"`
-		Contexts    []incidentContext `json:"contexts"`
+
+	return &Emitter{
+		store:        store,
+		sinks:        sinks,
+		keys:         keys,
+		ClaimTimeout: defaultClaimTimeout,
+		ClaimLease:   defaultClaimLease,
+		Retention:    defaultRetention,
+		ExpiryPolicy: ExpirySearch,
 	}
+}
 
-	const pdURL = "https://events.pagerduty.com/generic/2010-04-15/create_event.json"
+// expiresAt returns TTL of a cache record accessed at now.
+func (x *Emitter) expiresAt(now time.Time) int64 {
+	if x.Retention == 0 {
+		return 0
+	}
+	return now.Add(x.Retention).Unix()
+}
 
-	if token == "" {
-		return nil
+// claimExpiresAt returns end of the lease of a claim made at now. The writer
+// can not work after the deadline of ctx.
+func (x *Emitter) claimExpiresAt(ctx context.Context, now time.Time) int64 {
+	expires := now.Add(x.ClaimLease)
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(expires) {
+		expires = deadline
 	}
+	return expires.Unix()
+}
+
+var (
+	errClaimPending  = errors.New("The report is claimed by another writer")
+	errClaimReleased = errors.New("The claim of the report is released")
+)
+
+// waitClaim waits for another writer that claimed the report and returns
+// the cache created by the writer. It returns errClaimReleased if the writer
+// failed or the lease of the claim has passed.
+func (x *Emitter) waitClaim(ctx context.Context, reportID ar.ReportID) (*ReportCache, error) {
+	var cache *ReportCache
+
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = 100 * time.Millisecond
+	b.MaxElapsedTime = x.ClaimTimeout
+
+	err := backoff.Retry(func() error {
+		c, err := x.store.Get(ctx, reportID)
+		if err == ErrReportNotFound || (err == nil && c.claimExpired(time.Now())) {
+			return backoff.Permanent(errClaimReleased)
+		} else if err != nil {
+			return backoff.Permanent(err)
+		} else if c.isPending() {
+			return errClaimPending
+		}
+
+		cache = c
+		return nil
+	}, backoff.WithContext(b, ctx))
 
-	body := incidentBody{
-		ServiceKey:  token,
-		EventType:   "trigger",
-		Description: fmt.Sprintf("%s %s", url, title),
-		Client:      "issue",
-		ClientURL:   url,
-		Contexts: []incidentContext{
-			{
-				Type: "link",
-				Href: url,
-			},
-		},
+	if err == errClaimReleased {
+		return nil, err
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Fail to wait for the claimed report: %s", reportID)
 	}
+	return cache, nil
+}
 
-	log.WithField("body", body)
+// cacheStatus is a result of lookup.
+type cacheStatus int
+
+const (
+	// cacheHit means that the cache of the report exists.
+	cacheHit cacheStatus = iota
+	// cacheLost means that the cache is missing or expired, and the record
+	// is claimed. Sinks should recover their states before creating new ones.
+	cacheLost
+	// cacheRenew means that the cache is expired and the record is claimed
+	// to create a new issue.
+	cacheRenew
+)
 
-	data, err := json.Marshal(body)
-	if err != nil {
-		return err
+// lookup returns cache of the report. If no valid cache exists, it claims a
+// new record for the report. Then the caller must create the issue and put
+// the cache. If another writer already claimed it, lookup waits until the
+// writer puts the cache, or takes over the claim if the writer failed.
+func (x *Emitter) lookup(ctx context.Context, reportID ar.ReportID) (*ReportCache, cacheStatus, error) {
+	for {
+		cache, status, err := x.tryLookup(ctx, reportID)
+		if err != errClaimReleased {
+			return cache, status, err
+		}
+		log.WithField("reportID", reportID).Info("The claim is released, then claim again")
 	}
+}
 
-	req, err := http.NewRequest("POST", pdURL, bytes.NewBuffer(data))
-	if err != nil {
-		return err
+func (x *Emitter) tryLookup(ctx context.Context, reportID ar.ReportID) (*ReportCache, cacheStatus, error) {
+	now := time.Now()
+	cache, err := x.store.Get(ctx, reportID)
+	status := cacheLost
+	newCache := ReportCache{ReportID: reportID}
+
+	switch {
+	case err == ErrReportNotFound:
+	case err != nil:
+		return nil, cacheHit, errors.Wrap(err, "Fail to get cache DB")
+	case cache.claimExpired(now):
+		// A stale claim of a crashed writer. The writer may have created an
+		// issue, then take over states of sinks saved in the record and
+		// recover others.
+		log.WithField("cache", cache).Info("The claim is expired")
+		newCache = *cache
+	case cache.Expired(now):
+		log.WithField("cache", cache).Info("The cache is expired")
+		if x.ExpiryPolicy == ExpiryNewIssue {
+			status = cacheRenew
+		}
+	case cache.isPending():
+		log.WithField("reportID", reportID).Info("The report is claimed by another writer")
+		cache, err = x.waitClaim(ctx, reportID)
+		return cache, cacheHit, err
+	default:
+		return cache, cacheHit, nil
 	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	log.WithField("resp", resp).Info("sent a PD request")
+
+	newCache.TTL = x.expiresAt(now)
+	newCache.ClaimExpires = x.claimExpiresAt(ctx, now)
+	claimed, err := x.store.Claim(ctx, newCache)
 	if err != nil {
-		return err
+		return nil, cacheHit, errors.Wrap(err, "Fail to claim cache DB")
+	}
+	if claimed {
+		newCache.State = cacheStatePending
+		return &newCache, status, nil
 	}
-	defer resp.Body.Close()
 
-	var respData []byte
-	_, err = resp.Body.Read(respData)
-	if err != nil {
-		return err
+	log.WithField("reportID", reportID).Info("The report is claimed by another writer")
+	cache, err = x.waitClaim(ctx, reportID)
+	return cache, cacheHit, err
+}
+
+// runSinks runs the action of sinks and returns their results. A sink that
+// failed earlier in the emit is skipped, and so is an action done by the
+// last delivery of the same report. Errors of sinks are added to errs and
+// other sinks keep running.
+func (x *Emitter) runSinks(ctx context.Context, sinks []Sink, action string, report ar.Report, cache *ReportCache, errs *SinkErrors) []SinkResult {
+	results := []SinkResult{}
+
+	for _, sink := range sinks {
+		key := x.keys[sink]
+		if errs.failed(key) || cache.isDone(key, action) {
+			continue
+		}
+
+		var res *SinkResult
+		var err error
+
+		switch action {
+		case sinkCreate:
+			res, err = sink.Create(ctx, report, cache)
+		case sinkUpdate:
+			res, err = sink.Update(ctx, report, cache)
+		case sinkComment:
+			res, err = sink.Comment(ctx, report, cache)
+		case sinkResolve:
+			res, err = sink.Resolve(ctx, report, cache)
+		default:
+			err = fmt.Errorf("Invalid sink action: %s", action)
+		}
+
+		if err != nil {
+			log.WithError(err).WithField("sink", key).Error("Fail to " + action + " report")
+			*errs = append(*errs, &SinkError{Sink: key, Action: action, Err: err})
+			continue
+		}
+		cache.setDone(key, action)
+		if res != nil {
+			results = append(results, *res)
+		}
 	}
-	log.Printf("response: %s", string(respData))
 
-	return nil
+	return results
 }
 
-func EmitReport(report ar.Report, region, secretArn, tableName string) (*Result, error) {
-	result := Result{}
+// recoverSinks asks sinks to recover their states of the report into the
+// cache. It returns recovered sinks and the others.
+func (x *Emitter) recoverSinks(ctx context.Context, sinks []Sink, report ar.Report, cache *ReportCache, errs *SinkErrors) (recovered, others []Sink) {
+	for _, sink := range sinks {
+		if r, ok := sink.(Recoverer); ok {
+			found, err := r.Recover(ctx, report, cache)
+			if err != nil {
+				*errs = append(*errs, &SinkError{Sink: x.keys[sink], Action: "recover", Err: err})
+				continue
+			}
+			if found {
+				log.WithField("sink", sink.Name()).WithField("cache", cache).Info("Recovered cache")
+				cache.setDone(x.keys[sink], sinkCreate)
+				recovered = append(recovered, sink)
+				continue
+			}
+		}
+		others = append(others, sink)
+	}
 
-	// Get secrets from SecretsManager
-	var secrets secretValues
-	err := ar.GetSecretValues(secretArn, &secrets)
-	if err != nil {
-		return nil, errors.Wrap(err, "Can not get values from SecretsManager")
+	return recovered, others
+}
+
+// create creates the report in sinks for a claimed cache record. If the
+// cache is lost, sinks that recover their states get an update instead.
+// Sinks that created the report in a failed emit are skipped.
+func (x *Emitter) create(ctx context.Context, report ar.Report, cache *ReportCache, status cacheStatus, errs *SinkErrors) []SinkResult {
+	var newSinks []Sink
+	for _, sink := range x.sinks {
+		if !cache.isDone(x.keys[sink], sinkCreate) {
+			newSinks = append(newSinks, sink)
+		}
 	}
 
-	ghe, err := NewGitHub(secrets.GithubEndpoint, secrets.GithubRepository, secrets.GithubToken)
-	if err != nil {
-		return nil, errors.Wrap(err, "Fail to create github accessor")
+	results := []SinkResult{}
+	if status == cacheLost {
+		recovered, others := x.recoverSinks(ctx, newSinks, report, cache, errs)
+		newSinks = others
+
+		if report.IsNew() {
+			results = append(results, x.runSinks(ctx, recovered, sinkUpdate, report, cache, errs)...)
+		}
 	}
 
-	db := dynamo.New(session.New(), &aws.Config{Region: aws.String(region)})
-	table := db.Table(tableName)
+	return append(results, x.runSinks(ctx, newSinks, sinkCreate, report, cache, errs)...)
+}
+
+// Emit delivers the report to all sinks. If some sinks fail, it returns
+// SinkErrors after others finish. Progress of sinks is saved in the cache,
+// then the report delivered again is emitted only to the failed sinks.
+func (x *Emitter) Emit(ctx context.Context, report ar.Report) (*Result, error) {
+	result := Result{}
+	var errs SinkErrors
 
 	// Lookup existing issue item.
-	var cache reportCache
-	err = table.Get("report_id", report.ID).One(&cache)
-	var issue *GitHubIssue
+	cache, status, err := x.lookup(ctx, report.ID)
+	if err != nil {
+		return nil, err
+	}
+	cache.startProgress(reportDigest(report))
 
-	switch err {
-	case dynamo.ErrNotFound:
+	if status != cacheHit {
 		log.WithField("report", report).Info("The issue is not found")
 		// If not existing issue, create a new one.
-		body := BuildIssueBody(report)
-		title := report.Alert.Title()
-		body = fmt.Sprintf("ReportID: %s\n\n", report.ID) + body
-
-		issue, err = ghe.NewIssue(title, body)
-		if err != nil {
-			return nil, errors.Wrap(err, "Fail to create GHE issue")
+		result.Sinks = append(result.Sinks, x.create(ctx, report, cache, status, &errs)...)
+		if len(errs) > 0 {
+			// Keep states of sinks that created the report for the next
+			// writer.
+			x.release(cache)
+			return nil, errs
 		}
-		cache.ReportID = report.ID
-		cache.IssueURL = issue.ApiURL
-		cache.HtmlURL = issue.HtmlURL
 
-		if err := table.Put(cache).Run(); err != nil {
-			return nil, errors.Wrap(err, "Fail to set cache to DynamoDB")
+		// Put the cache immediately to release other writers waiting for it.
+		cache.State = cacheStateReady
+		cache.ClaimExpires = 0
+		if err := x.store.Put(ctx, *cache); err != nil {
+			x.release(cache)
+			return nil, err
 		}
 		log.WithField("issue", cache).Info("new issue")
-
-	case nil:
+	} else {
 		log.WithField("issue", cache).Info("The issue exists")
 
-		issue, err = ghe.GetIssue(cache.IssueURL)
-		if err != nil {
-			return nil, errors.Wrap(err, "Fail to get GHE issue")
-		}
-
 		if report.IsNew() {
-			body := BuildIssueBody(report)
-			issue.AppendContent(body)
+			results := x.runSinks(ctx, x.sinks, sinkUpdate, report, cache, &errs)
+			result.Sinks = append(result.Sinks, results...)
 		}
-
-	default:
-		return nil, errors.Wrap(err, "Fail to get cache DB")
 	}
 
-	result.ApiURL = issue.ApiURL
-	result.HtmlURL = issue.HtmlURL
-
-	commentHdr := BuildPublishedReportHeader(report)
-	commentBody := BuildCommentBody(report)
-	log.Println("Comment: ", commentBody)
+	result.ApiURL = cache.IssueURL
+	result.HtmlURL = cache.HtmlURL
 
 	if report.IsPublished() {
-		if report.Result.Severity == ar.SevSafe {
-			err := issue.Close()
-			if err != nil {
-				return nil, err
+		results := x.runSinks(ctx, x.sinks, sinkComment, report, cache, &errs)
+		result.Sinks = append(result.Sinks, results...)
+
+		for _, r := range results {
+			if r.Sink == githubSinkName {
+				result.CommentApiURL = r.ApiURL
+				result.CommentHtmlURL = r.HtmlURL
+			}
+			if r.Paging != nil {
+				result.Paging = r.Paging
 			}
 		}
 
-		body := commentHdr + commentBody
-		comment, err := issue.AddComment(body)
-		if err != nil {
-			return nil, errors.Wrap(err, "Fail to add a comment to GHE issue")
+		if report.Result.Severity == ar.SevSafe {
+			results := x.runSinks(ctx, x.sinks, sinkResolve, report, cache, &errs)
+			result.Sinks = append(result.Sinks, results...)
 		}
+	}
 
-		result.CommentApiURL = comment.ApiURL
-		result.CommentHtmlURL = comment.HtmlURL
+	// Refresh TTL of the cache because the report is still alive. Progress
+	// is kept until all sinks succeed.
+	cache.TTL = x.expiresAt(time.Now())
+	if len(errs) == 0 {
+		cache.clearProgress()
+	}
+	if err := x.store.Put(ctx, *cache); err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
 
-		if report.Result.Severity != ar.SevSafe {
-			err := CreatePagerDutyIncident(secrets.PagerDutyToken, report.Alert.Title(), result.CommentHtmlURL)
+	log.WithField("result", result).Info("")
 
-			if err != nil {
-				return nil, err
-			}
+	return &result, nil
+}
+
+// reportDigest returns digest of the report to find the same report
+// delivered again.
+func reportDigest(report ar.Report) string {
+	raw, err := json.Marshal(report)
+	if err != nil {
+		// Progress is not shared with any other report.
+		return ""
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// release puts the cache with the claim released after a failure, even if
+// ctx is already cancelled. The next writer takes over states of sinks in
+// the cache instead of creating them again. If it fails, the claim is taken
+// over after the lease.
+func (x *Emitter) release(cache *ReportCache) {
+	cache.ClaimExpires = 0
+	if err := x.store.Put(context.Background(), *cache); err != nil {
+		log.WithError(err).WithField("cache", cache).Warn("Fail to release claim of the report")
+	}
+}
+
+func EmitReport(ctx context.Context, report ar.Report, region, secretArn, tableName string) (*Result, error) {
+	// Get secrets from SecretsManager
+	var secrets secretValues
+	err := ar.GetSecretValues(secretArn, &secrets)
+	if err != nil {
+		return nil, errors.Wrap(err, "Can not get values from SecretsManager")
+	}
+
+	order, err := loadSectionOrder()
+	if err != nil {
+		return nil, err
+	}
+	sinks, err := newSinks(secrets, order)
+	if err != nil {
+		return nil, err
+	}
+
+	emitter := NewEmitter(NewDynamoStore(region, tableName), sinks)
+	if err := configureEmitter(emitter); err != nil {
+		return nil, err
+	}
+	return emitter.Emit(ctx, report)
+}
+
+// configureEmitter sets options of Emitter by environment variables.
+func configureEmitter(emitter *Emitter) error {
+	if v := os.Getenv("CACHE_RETENTION_DAYS"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 0 {
+			return fmt.Errorf("Invalid CACHE_RETENTION_DAYS: %s", v)
 		}
+		emitter.Retention = time.Duration(days) * 24 * time.Hour
 	}
 
-	log.WithField("result", result).Info("")
+	switch policy := ExpiryPolicy(os.Getenv("CACHE_EXPIRY_POLICY")); policy {
+	case "":
+	case ExpiryNewIssue, ExpirySearch:
+		emitter.ExpiryPolicy = policy
+	default:
+		return fmt.Errorf("Invalid CACHE_EXPIRY_POLICY: %s", policy)
+	}
 
-	return &result, nil
+	return nil
 }
 
+// loadSectionOrder returns ordering of sections in published reports by
+// environment variables, e.g. OPPONENT_HOST_ORDER=relevance.
+func loadSectionOrder() (SectionOrder, error) {
+	order := SectionOrder{
+		AlliedHost:   os.Getenv("ALLIED_HOST_ORDER"),
+		OpponentHost: os.Getenv("OPPONENT_HOST_ORDER"),
+		SubjectUser:  os.Getenv("SUBJECT_USER_ORDER"),
+	}
+	if err := order.Validate(); err != nil {
+		return SectionOrder{}, err
+	}
+	return order, nil
+}
+
+// deadlineMargin is time reserved to stop work cleanly before timeout of
+// the Lambda function.
+const deadlineMargin = 10 * time.Second
+
 func main() {
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetLevel(log.InfoLevel)
@@ -210,6 +549,12 @@ func main() {
 	lambda.Start(func(ctx context.Context, event events.SNSEvent) (string, error) {
 		log.WithField("SNSevent", event).Info("Start")
 
+		if deadline, ok := ctx.Deadline(); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline.Add(-deadlineMargin))
+			defer cancel()
+		}
+
 		// Get region
 		region := os.Getenv("AWS_REGION")
 		if region == "" {
@@ -217,6 +562,11 @@ func main() {
 		}
 
 		for _, record := range event.Records {
+			if err := ctx.Err(); err != nil {
+				log.WithError(err).Error("Stop emitting reports before timeout")
+				return "ng", err
+			}
+
 			var report ar.Report
 			err := json.Unmarshal([]byte(record.SNS.Message), &report)
 			if err != nil {
@@ -224,7 +574,7 @@ func main() {
 			}
 
 			log.WithField("report", report).Info("Extrated report")
-			result, err := EmitReport(report, region, os.Getenv("SECRET_ARN"), os.Getenv("TABLE_NAME"))
+			result, err := EmitReport(ctx, report, region, os.Getenv("SECRET_ARN"), os.Getenv("TABLE_NAME"))
 			if err != nil {
 				log.WithError(err).Error("Fail to emit report")
 				return "ng", err
@@ -1,17 +1,24 @@
 package main_test
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	ar "github.com/m-mizutani/AlertResponder/lib"
 	main "github.com/m-mizutani/GithubEmitter"
+	"github.com/pkg/errors"
 	uuid "github.com/satori/go.uuid"
 )
 
@@ -42,6 +49,24 @@ func loadTestConfig(params interface{}) {
 	return
 }
 
+// fakeServer is a HTTP stub of an API for tests. A fake embeds it and
+// starts it with the handler, that is called with the mutex locked to update
+// state of the fake.
+type fakeServer struct {
+	server *httptest.Server
+	mutex  sync.Mutex
+}
+
+func (x *fakeServer) start(handler http.HandlerFunc) {
+	x.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		x.mutex.Lock()
+		defer x.mutex.Unlock()
+		handler(w, r)
+	}))
+}
+
+func (x *fakeServer) Close() { x.server.Close() }
+
 func genDummyReport() ar.Report {
 	alertKey := uuid.NewV4().String()
 
@@ -112,13 +137,364 @@ func genDummyReport() ar.Report {
 	return report
 }
 
+type dummySink struct {
+	actions []string
+}
+
+func (x *dummySink) Name() string { return "dummy" }
+
+func (x *dummySink) do(action string, cache *main.ReportCache) (*main.SinkResult, error) {
+	x.actions = append(x.actions, action)
+	if cache.IssueURL == "" {
+		cache.IssueURL = "https://example.com/issues/" + string(cache.ReportID)
+	}
+	return &main.SinkResult{Sink: x.Name(), Action: action, ApiURL: cache.IssueURL}, nil
+}
+
+func (x *dummySink) Create(ctx context.Context, report ar.Report, cache *main.ReportCache) (*main.SinkResult, error) {
+	return x.do("create", cache)
+}
+
+func (x *dummySink) Update(ctx context.Context, report ar.Report, cache *main.ReportCache) (*main.SinkResult, error) {
+	return x.do("update", cache)
+}
+
+func (x *dummySink) Comment(ctx context.Context, report ar.Report, cache *main.ReportCache) (*main.SinkResult, error) {
+	return x.do("comment", cache)
+}
+
+func (x *dummySink) Resolve(ctx context.Context, report ar.Report, cache *main.ReportCache) (*main.SinkResult, error) {
+	return x.do("resolve", cache)
+}
+
+func TestEmitter(t *testing.T) {
+	ctx := context.Background()
+	sink := &dummySink{}
+	store := main.NewMemoryStore()
+	emitter := main.NewEmitter(store, []main.Sink{sink})
+
+	report := genDummyReport()
+	report.Status = ar.StatusNew
+	resp, err := emitter.Emit(ctx, report)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/issues/"+string(report.ID), resp.ApiURL)
+	assert.Equal(t, []string{"create"}, sink.actions)
+
+	cache, err := store.Get(ctx, report.ID)
+	require.NoError(t, err)
+	assert.Equal(t, resp.ApiURL, cache.IssueURL)
+
+	_, err = emitter.Emit(ctx, report)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"create", "update"}, sink.actions)
+
+	report.Status = ar.StatusPublished
+	report.Result.Severity = ar.SevSafe
+	resp, err = emitter.Emit(ctx, report)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"create", "update", "comment", "resolve"}, sink.actions)
+	assert.Equal(t, 2, len(resp.Sinks))
+}
+
+// failSink fails each action in fails once.
+type failSink struct {
+	name    string
+	fails   map[string]bool
+	actions []string
+}
+
+func (x *failSink) Name() string { return x.name }
+
+func (x *failSink) do(action string) (*main.SinkResult, error) {
+	if x.fails[action] {
+		delete(x.fails, action)
+		return nil, errors.New("Sink is down")
+	}
+	x.actions = append(x.actions, action)
+	return &main.SinkResult{Sink: x.Name(), Action: action}, nil
+}
+
+func (x *failSink) Create(ctx context.Context, report ar.Report, cache *main.ReportCache) (*main.SinkResult, error) {
+	return x.do("create")
+}
+
+func (x *failSink) Update(ctx context.Context, report ar.Report, cache *main.ReportCache) (*main.SinkResult, error) {
+	return x.do("update")
+}
+
+func (x *failSink) Comment(ctx context.Context, report ar.Report, cache *main.ReportCache) (*main.SinkResult, error) {
+	return x.do("comment")
+}
+
+func (x *failSink) Resolve(ctx context.Context, report ar.Report, cache *main.ReportCache) (*main.SinkResult, error) {
+	return x.do("resolve")
+}
+
+func TestEmitterSinkError(t *testing.T) {
+	ctx := context.Background()
+	first := &failSink{name: "first", fails: map[string]bool{"create": true}}
+	second := &failSink{name: "second", fails: map[string]bool{}}
+	third := &failSink{name: "second", fails: map[string]bool{"comment": true}}
+	emitter := main.NewEmitter(main.NewMemoryStore(), []main.Sink{first, second, third})
+
+	// Other sinks keep running after a failed sink.
+	report := genDummyReport()
+	report.Status = ar.StatusNew
+	_, err := emitter.Emit(ctx, report)
+	require.Error(t, err)
+	sinkErrs, ok := err.(main.SinkErrors)
+	require.True(t, ok)
+	require.Equal(t, 1, len(sinkErrs))
+	assert.Equal(t, "first", sinkErrs[0].Sink)
+	assert.Equal(t, "create", sinkErrs[0].Action)
+	assert.Equal(t, []string{"create"}, second.actions)
+	assert.Equal(t, []string{"create"}, third.actions)
+
+	// The same report delivered again creates it only in the failed sink.
+	_, err = emitter.Emit(ctx, report)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"create"}, first.actions)
+	assert.Equal(t, []string{"create"}, second.actions)
+	assert.Equal(t, []string{"create"}, third.actions)
+
+	// A new alert of the report updates all sinks even if it's the same.
+	_, err = emitter.Emit(ctx, report)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"create", "update"}, first.actions)
+
+	// Sinks with the same name have their own progress.
+	report.Status = ar.StatusPublished
+	report.Result.Severity = ar.SevSafe
+	first.fails["resolve"] = true
+	_, err = emitter.Emit(ctx, report)
+	require.Error(t, err)
+	sinkErrs, ok = err.(main.SinkErrors)
+	require.True(t, ok)
+	require.Equal(t, 2, len(sinkErrs))
+	assert.Equal(t, "second#2", sinkErrs[0].Sink)
+	assert.Equal(t, "comment", sinkErrs[0].Action)
+	assert.Equal(t, "first", sinkErrs[1].Sink)
+	assert.Equal(t, "resolve", sinkErrs[1].Action)
+	assert.Equal(t, []string{"create", "update", "comment", "resolve"}, second.actions)
+	// A sink that failed to comment does not resolve the report.
+	assert.Equal(t, []string{"create", "update"}, third.actions)
+
+	_, err = emitter.Emit(ctx, report)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"create", "update", "comment", "resolve"}, first.actions)
+	assert.Equal(t, []string{"create", "update", "comment", "resolve"}, second.actions)
+	assert.Equal(t, []string{"create", "update", "comment", "resolve"}, third.actions)
+}
+
+type recoverSink struct {
+	dummySink
+	found bool
+}
+
+func (x *recoverSink) Recover(ctx context.Context, report ar.Report, cache *main.ReportCache) (bool, error) {
+	x.actions = append(x.actions, "recover")
+	if !x.found {
+		return false, nil
+	}
+	cache.IssueURL = "https://example.com/recovered"
+	return true, nil
+}
+
+func TestEmitterExpiredCache(t *testing.T) {
+	ctx := context.Background()
+	testCases := []struct {
+		policy  main.ExpiryPolicy
+		found   bool
+		actions []string
+		url     string
+	}{
+		{main.ExpiryNewIssue, true, []string{"create"}, "https://example.com/issues/"},
+		{main.ExpirySearch, true, []string{"recover", "update"}, "https://example.com/recovered"},
+		{main.ExpirySearch, false, []string{"recover", "create"}, "https://example.com/issues/"},
+	}
+
+	for _, tc := range testCases {
+		sink := &recoverSink{found: tc.found}
+		store := main.NewMemoryStore()
+		emitter := main.NewEmitter(store, []main.Sink{sink})
+		emitter.ExpiryPolicy = tc.policy
+
+		report := genDummyReport()
+		report.Status = ar.StatusNew
+
+		past := time.Now().Add(-time.Hour).Unix()
+		require.NoError(t, store.Put(ctx, main.ReportCache{
+			ReportID: report.ID,
+			IssueURL: "https://example.com/old",
+			TTL:      past,
+		}))
+
+		resp, err := emitter.Emit(ctx, report)
+		require.NoError(t, err)
+		assert.Equal(t, tc.actions, sink.actions)
+		assert.Contains(t, resp.ApiURL, tc.url)
+
+		cache, err := store.Get(ctx, report.ID)
+		require.NoError(t, err)
+		assert.False(t, cache.Expired(time.Now()))
+		assert.Equal(t, resp.ApiURL, cache.IssueURL)
+	}
+}
+
+func TestEmitterLostCache(t *testing.T) {
+	ctx := context.Background()
+	sink := &recoverSink{found: true}
+	other := &dummySink{}
+	emitter := main.NewEmitter(main.NewMemoryStore(), []main.Sink{sink, other})
+
+	report := genDummyReport()
+	report.Status = ar.StatusNew
+
+	resp, err := emitter.Emit(ctx, report)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/recovered", resp.ApiURL)
+	assert.Equal(t, []string{"recover", "update"}, sink.actions)
+	// A sink that can not recover creates a new one.
+	assert.Equal(t, []string{"create"}, other.actions)
+}
+
+type slowSink struct {
+	dummySink
+	mutex   sync.Mutex
+	created int
+}
+
+func (x *slowSink) Create(ctx context.Context, report ar.Report, cache *main.ReportCache) (*main.SinkResult, error) {
+	x.mutex.Lock()
+	x.created++
+	x.mutex.Unlock()
+
+	time.Sleep(200 * time.Millisecond)
+	cache.IssueURL = "https://example.com/issues/" + string(cache.ReportID)
+	return &main.SinkResult{Sink: x.Name(), Action: "create", ApiURL: cache.IssueURL}, nil
+}
+
+func (x *slowSink) Update(ctx context.Context, report ar.Report, cache *main.ReportCache) (*main.SinkResult, error) {
+	return nil, nil
+}
+
+func TestEmitterConcurrentCreate(t *testing.T) {
+	ctx := context.Background()
+	sink := &slowSink{}
+	emitter := main.NewEmitter(main.NewMemoryStore(), []main.Sink{sink})
+	emitter.ClaimTimeout = 5 * time.Second
+
+	report := genDummyReport()
+	report.Status = ar.StatusNew
+
+	var wg sync.WaitGroup
+	urls := make([]string, 4)
+	for i := range urls {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := emitter.Emit(ctx, report)
+			if assert.NoError(t, err) {
+				urls[i] = resp.ApiURL
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, sink.created)
+	for _, url := range urls {
+		assert.Equal(t, "https://example.com/issues/"+string(report.ID), url)
+	}
+}
+
+// crashSink creates an issue and kills the writer before it puts the cache.
+type crashSink struct {
+	recoverSink
+	crash bool
+}
+
+func (x *crashSink) Create(ctx context.Context, report ar.Report, cache *main.ReportCache) (*main.SinkResult, error) {
+	if x.crash {
+		x.found = true
+		runtime.Goexit()
+	}
+	return x.recoverSink.Create(ctx, report, cache)
+}
+
+func TestEmitterCrashedWriter(t *testing.T) {
+	ctx := context.Background()
+	sink := &crashSink{crash: true}
+	emitter := main.NewEmitter(main.NewMemoryStore(), []main.Sink{sink})
+	emitter.ClaimTimeout = 300 * time.Millisecond
+	emitter.ClaimLease = time.Second
+
+	report := genDummyReport()
+	report.Status = ar.StatusNew
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		emitter.Emit(ctx, report)
+	}()
+	<-done
+	sink.crash = false
+
+	// The claim of the crashed writer is alive.
+	_, err := emitter.Emit(ctx, report)
+	assert.Error(t, err)
+
+	// A later writer takes over the claim and recovers the issue.
+	time.Sleep(2 * time.Second)
+	resp, err := emitter.Emit(ctx, report)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/recovered", resp.ApiURL)
+	assert.Equal(t, []string{"recover", "recover", "update"}, sink.actions)
+
+	_, err = emitter.Emit(ctx, report)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"recover", "recover", "update", "update"}, sink.actions)
+}
+
+// flakyStore fails to put records for the number of times.
+type flakyStore struct {
+	*main.MemoryStore
+	fails int
+}
+
+func (x *flakyStore) Put(ctx context.Context, cache main.ReportCache) error {
+	if x.fails > 0 {
+		x.fails--
+		return errors.New("Put is failed")
+	}
+	return x.MemoryStore.Put(ctx, cache)
+}
+
+func TestEmitterPutFailure(t *testing.T) {
+	ctx := context.Background()
+	sink := &dummySink{}
+	store := &flakyStore{MemoryStore: main.NewMemoryStore(), fails: 1}
+	emitter := main.NewEmitter(store, []main.Sink{sink})
+	emitter.ClaimTimeout = 300 * time.Millisecond
+
+	report := genDummyReport()
+	report.Status = ar.StatusNew
+	_, err := emitter.Emit(ctx, report)
+	assert.Error(t, err)
+
+	// The claim is released with the issue, then it's not created again.
+	resp, err := emitter.Emit(ctx, report)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/issues/"+string(report.ID), resp.ApiURL)
+	assert.Equal(t, []string{"create", "update"}, sink.actions)
+}
+
 func TestAlertPost(t *testing.T) {
 	var params testParams
 	loadTestConfig(&params)
 
 	report := genDummyReport()
 
-	resp, err := main.EmitReport(report, params.Region, params.SecretArn, params.TableName)
+	resp, err := main.EmitReport(context.Background(), report, params.Region, params.SecretArn, params.TableName)
 	report.Status = ar.StatusPublished
 
 	assert.NoError(t, err)
@@ -130,13 +506,13 @@ func TestAlertPost(t *testing.T) {
 
 		// Overwrite
 		report.Content.OpponentHosts = map[string]ar.ReportOpponentHost{}
-		respNoPage, err := main.EmitReport(report, params.Region, params.SecretArn, params.TableName)
+		respNoPage, err := main.EmitReport(context.Background(), report, params.Region, params.SecretArn, params.TableName)
 		assert.NoError(t, err)
 		assert.Equal(t, resp.ApiURL, respNoPage.ApiURL)
 		assert.Contains(t, respNoPage.ApiURL, "https://")
 
 		report.ID = ar.NewReportID()
-		respNewID, err := main.EmitReport(report, params.Region, params.SecretArn, params.TableName)
+		respNewID, err := main.EmitReport(context.Background(), report, params.Region, params.SecretArn, params.TableName)
 
 		assert.NoError(t, err)
 		assert.NotEqual(t, resp.ApiURL, respNewID.ApiURL)
@@ -152,7 +528,7 @@ func TestPagerDuty(t *testing.T) {
 	report := genDummyReport()
 	report.Status = ar.StatusPublished
 	report.Result.Severity = ar.SevUrgent
-	resp, err := main.EmitReport(report, params.Region, params.SecretArn, params.TableName)
+	resp, err := main.EmitReport(context.Background(), report, params.Region, params.SecretArn, params.TableName)
 
 	assert.NoError(t, err)
 	assert.NotNil(t, resp)
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+var (
+	mdHeading   = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	mdBullet    = regexp.MustCompile(`^(\s*)[-*]\s+(.*)$`)
+	mdRule      = regexp.MustCompile(`^(-\s*){3,}$`)
+	mdTableSep  = regexp.MustCompile(`^\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?$`)
+	mdBold      = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	wikiLinkURL = strings.NewReplacer("[", "%5B", "]", "%5D")
+)
+
+// Kinds of inline Markdown tokens.
+const (
+	mdTokenText = iota
+	mdTokenCode
+	mdTokenEscaped
+	mdTokenLink
+)
+
+// mdToken is an inline token. text of a link is inline Markdown of the link
+// text.
+type mdToken struct {
+	kind int
+	text string
+	url  string
+}
+
+func isASCIIPunct(c byte) bool {
+	return ('!' <= c && c <= '/') || (':' <= c && c <= '@') ||
+		('[' <= c && c <= '`') || ('{' <= c && c <= '~')
+}
+
+// backtickRun returns length of the run of backticks at s[i:].
+func backtickRun(s string, i int) int {
+	n := 0
+	for i+n < len(s) && s[i+n] == '`' {
+		n++
+	}
+	return n
+}
+
+// closingBacktick returns position of the run of n backticks that closes a
+// code span opened by n backticks before i, or -1 if none.
+func closingBacktick(s string, i, n int) int {
+	for i < len(s) {
+		if m := backtickRun(s, i); m == n {
+			return i
+		} else if m > 0 {
+			i += m
+		} else {
+			i++
+		}
+	}
+	return -1
+}
+
+// scanLink returns text and URL of a link "[text](url)" at s[i:] and the
+// position after it. Brackets in code spans and escaped brackets do not end
+// the text.
+func scanLink(s string, i int) (text, url string, end int, ok bool) {
+	for j := i + 1; j < len(s); {
+		switch {
+		case s[j] == '\\' && j+1 < len(s) && isASCIIPunct(s[j+1]):
+			j += 2
+		case s[j] == '`':
+			n := backtickRun(s, j)
+			if closing := closingBacktick(s, j+n, n); closing >= 0 {
+				j = closing + n
+			} else {
+				j += n
+			}
+		case s[j] == '[':
+			return "", "", 0, false
+		case s[j] == ']':
+			if j+1 >= len(s) || s[j+1] != '(' {
+				return "", "", 0, false
+			}
+			k := strings.IndexAny(s[j+2:], ") \t(")
+			if k <= 0 || s[j+2+k] != ')' {
+				return "", "", 0, false
+			}
+			return s[i+1 : j], s[j+2 : j+2+k], j + 3 + k, true
+		default:
+			j++
+		}
+	}
+	return "", "", 0, false
+}
+
+// tokenizeInline splits inline Markdown into text, code spans, links and
+// backslash escaped characters. A code span is closed by a run of backticks
+// of the same length as the opening one.
+func tokenizeInline(s string) []mdToken {
+	tokens := []mdToken{}
+	var buf strings.Builder
+	flush := func() {
+		if buf.Len() > 0 {
+			tokens = append(tokens, mdToken{kind: mdTokenText, text: buf.String()})
+			buf.Reset()
+		}
+	}
+
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && isASCIIPunct(s[i+1]):
+			flush()
+			tokens = append(tokens, mdToken{kind: mdTokenEscaped, text: s[i+1 : i+2]})
+			i += 2
+			continue
+
+		case s[i] == '[':
+			if text, url, end, ok := scanLink(s, i); ok {
+				flush()
+				tokens = append(tokens, mdToken{kind: mdTokenLink, text: text, url: url})
+				i = end
+				continue
+			}
+
+		case s[i] == '`':
+			n := backtickRun(s, i)
+			closing := closingBacktick(s, i+n, n)
+			if closing < 0 {
+				buf.WriteString(s[i : i+n])
+				i += n
+				continue
+			}
+
+			code := s[i+n : closing]
+			if len(code) >= 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+				code = code[1 : len(code)-1]
+			}
+			flush()
+			tokens = append(tokens, mdToken{kind: mdTokenCode, text: code})
+			i = closing + n
+			continue
+		}
+
+		buf.WriteByte(s[i])
+		i++
+	}
+	flush()
+	return tokens
+}
+
+// isWebURL returns true if the URL is http or https.
+func isWebURL(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
+
+// codeFenceOf returns length of the backtick fence if the line is a fence of
+// a code block, and the language after it.
+func codeFenceOf(line string) (int, string) {
+	trimmed := strings.TrimSpace(line)
+	n := backtickRun(trimmed, 0)
+	if n < 3 {
+		return 0, ""
+	}
+	return n, strings.TrimSpace(trimmed[n:])
+}
+
+// isClosingFence returns true if the line closes a code block opened by a
+// fence of n backticks.
+func isClosingFence(line string, n int) bool {
+	m, info := codeFenceOf(line)
+	return m >= n && info == ""
+}
+
+// wikiEscaped are characters that Jira wiki markup interprets.
+const wikiEscaped = "*_-+^~?[]|{}!#"
+
+// jiraInline converts inline Markdown of body.go (code span, bold, link and
+// backslash escape) to Jira wiki markup.
+func jiraInline(text string) string {
+	var b strings.Builder
+	for _, token := range tokenizeInline(text) {
+		switch token.kind {
+		case mdTokenCode:
+			code := strings.TrimSpace(token.text)
+			if code == "" {
+				code = " "
+			}
+			b.WriteString("{{" + jiraEscape(code) + "}}")
+		case mdTokenEscaped:
+			b.WriteString(jiraEscape(token.text))
+		case mdTokenLink:
+			// A link is kept only for http and https URL, and the URL can not
+			// close the link.
+			if u, ok := safeLinkURL(token.url); ok {
+				b.WriteString("[" + jiraInline(token.text) + "|" + wikiLinkURL.Replace(u) + "]")
+			} else {
+				b.WriteString(jiraInline(token.text))
+			}
+		default:
+			b.WriteString(jiraText(token.text))
+		}
+	}
+	return b.String()
+}
+
+// jiraEscape escapes characters of literal text for Jira wiki markup.
+func jiraEscape(text string) string {
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case r == '\\':
+			// "\\" is a line break in Jira.
+			b.WriteString("&#92;")
+		case strings.ContainsRune(wikiEscaped, r):
+			b.WriteString("\\" + string(r))
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// jiraText escapes all characters of text that Jira interprets (e.g.
+// "!image!", "-x-", "[text|url]"), then only bold converted from Markdown is
+// markup in the result.
+func jiraText(text string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range mdBold.FindAllStringSubmatchIndex(text, -1) {
+		b.WriteString(jiraEscape(text[last:m[0]]))
+		b.WriteString("*" + jiraEscape(text[m[2]:m[3]]) + "*")
+		last = m[1]
+	}
+	b.WriteString(jiraEscape(text[last:]))
+	return b.String()
+}
+
+// splitTableRow returns cells of a Markdown table row. Pipes at both ends
+// are optional, and an escaped pipe (\|) does not split cells.
+func splitTableRow(line string) []string {
+	line = strings.TrimSpace(line)
+	line = strings.TrimPrefix(line, "|")
+	if strings.HasSuffix(line, "|") && !strings.HasSuffix(line, `\|`) {
+		line = strings.TrimSuffix(line, "|")
+	}
+
+	cells := []string{}
+	last := 0
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+		} else if line[i] == '|' {
+			cells = append(cells, strings.TrimSpace(line[last:i]))
+			last = i + 1
+		}
+	}
+	return append(cells, strings.TrimSpace(line[last:]))
+}
+
+func jiraTableRow(cells []string, sep string) string {
+	converted := make([]string, len(cells))
+	for i, cell := range cells {
+		if cell == "" {
+			// Jira drops an empty cell.
+			cell = " "
+		}
+		converted[i] = jiraInline(cell)
+	}
+	return sep + strings.Join(converted, sep) + sep
+}
+
+// MarkdownToJiraWiki converts Markdown built by body.go into Jira wiki
+// markup. It supports headings, nested bullets, fenced code blocks, tables,
+// code spans, bold and links, that are used in issue and comment bodies.
+func MarkdownToJiraWiki(md string) string {
+	lines := strings.Split(strings.Replace(md, "\r\n", "\n", -1), "\n")
+	out := []string{}
+	fence := 0
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		if fence > 0 {
+			if isClosingFence(line, fence) {
+				out = append(out, "{code}")
+				fence = 0
+			} else {
+				out = append(out, strings.Replace(line, "{code}", `\{code\}`, -1))
+			}
+			continue
+		}
+		if n, lang := codeFenceOf(line); n > 0 {
+			if lang != "" {
+				out = append(out, "{code:"+lang+"}")
+			} else {
+				out = append(out, "{code}")
+			}
+			fence = n
+			continue
+		}
+
+		// A table starts with a header row followed by a separator row.
+		if strings.Contains(line, "|") && i+1 < len(lines) &&
+			strings.Contains(lines[i+1], "-") && mdTableSep.MatchString(strings.TrimSpace(lines[i+1])) {
+			out = append(out, jiraTableRow(splitTableRow(line), "||"))
+			i++
+			for i+1 < len(lines) && strings.Contains(lines[i+1], "|") {
+				i++
+				out = append(out, jiraTableRow(splitTableRow(lines[i]), "|"))
+			}
+			continue
+		}
+
+		switch {
+		case mdRule.MatchString(trimmed):
+			out = append(out, "----")
+		case mdHeading.MatchString(line):
+			m := mdHeading.FindStringSubmatch(line)
+			out = append(out, "h"+string('0'+rune(len(m[1])))+". "+jiraInline(m[2]))
+		case mdBullet.MatchString(line):
+			m := mdBullet.FindStringSubmatch(line)
+			depth := len(strings.Replace(m[1], "\t", "  ", -1))/2 + 1
+			out = append(out, strings.Repeat("*", depth)+" "+jiraInline(m[2]))
+		default:
+			out = append(out, jiraInline(line))
+		}
+	}
+
+	if fence > 0 {
+		out = append(out, "{code}")
+	}
+	return strings.Join(out, "\n")
+}
+
+// htmlInline converts inline Markdown of body.go to HTML. Text is escaped,
+// and a link is kept only for http and https URL.
+func htmlInline(text string) string {
+	var b strings.Builder
+	for _, token := range tokenizeInline(text) {
+		switch token.kind {
+		case mdTokenCode:
+			b.WriteString("<code>" + html.EscapeString(token.text) + "</code>")
+		case mdTokenEscaped:
+			b.WriteString(html.EscapeString(token.text))
+		case mdTokenLink:
+			if isWebURL(token.url) {
+				fmt.Fprintf(&b, `<a href="%s">%s</a>`, html.EscapeString(token.url), htmlInline(token.text))
+			} else {
+				b.WriteString(htmlInline(token.text))
+			}
+		default:
+			b.WriteString(htmlText(token.text))
+		}
+	}
+	return b.String()
+}
+
+func htmlText(text string) string {
+	text = html.EscapeString(text)
+	return mdBold.ReplaceAllString(text, "<strong>$1</strong>")
+}
+
+func htmlTableRow(cells []string, tag string) string {
+	var b strings.Builder
+	b.WriteString("<tr>")
+	for _, cell := range cells {
+		b.WriteString("<" + tag + ">" + htmlInline(cell) + "</" + tag + ">")
+	}
+	b.WriteString("</tr>")
+	return b.String()
+}
+
+// MarkdownToHTML converts Markdown built by body.go into a HTML fragment. It
+// supports the same syntax as MarkdownToJiraWiki.
+func MarkdownToHTML(md string) string {
+	lines := strings.Split(strings.Replace(md, "\r\n", "\n", -1), "\n")
+	out := []string{}
+
+	// Each open list level has an open <li> to nest a child list in it.
+	depth := 0
+	closeLists := func(to int) {
+		for ; depth > to; depth-- {
+			out = append(out, "</li></ul>")
+		}
+	}
+
+	var code []string
+	fence := 0
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		if fence > 0 {
+			if isClosingFence(line, fence) {
+				out = append(out, "<pre><code>"+strings.Join(code, "\n")+"</code></pre>")
+				code = nil
+				fence = 0
+			} else {
+				code = append(code, html.EscapeString(line))
+			}
+			continue
+		}
+		if n, _ := codeFenceOf(line); n > 0 {
+			closeLists(0)
+			fence = n
+			continue
+		}
+
+		if strings.Contains(line, "|") && i+1 < len(lines) &&
+			strings.Contains(lines[i+1], "-") && mdTableSep.MatchString(strings.TrimSpace(lines[i+1])) {
+			closeLists(0)
+			out = append(out, "<table>", htmlTableRow(splitTableRow(line), "th"))
+			i++
+			for i+1 < len(lines) && strings.Contains(lines[i+1], "|") {
+				i++
+				out = append(out, htmlTableRow(splitTableRow(lines[i]), "td"))
+			}
+			out = append(out, "</table>")
+			continue
+		}
+
+		switch {
+		case trimmed == "":
+			closeLists(0)
+		case mdRule.MatchString(trimmed):
+			closeLists(0)
+			out = append(out, "<hr>")
+		case mdHeading.MatchString(line):
+			closeLists(0)
+			m := mdHeading.FindStringSubmatch(line)
+			out = append(out, fmt.Sprintf("<h%d>%s</h%d>", len(m[1]), htmlInline(m[2]), len(m[1])))
+		case mdBullet.MatchString(line):
+			m := mdBullet.FindStringSubmatch(line)
+			d := len(strings.Replace(m[1], "\t", "  ", -1))/2 + 1
+			if d <= depth {
+				closeLists(d)
+				out = append(out, "</li>")
+			}
+			for depth < d {
+				out = append(out, "<ul>")
+				depth++
+				if depth < d {
+					out = append(out, "<li>")
+				}
+			}
+			out = append(out, "<li>"+htmlInline(m[2]))
+		default:
+			closeLists(0)
+			out = append(out, "<p>"+htmlInline(line)+"</p>")
+		}
+	}
+
+	if fence > 0 {
+		out = append(out, "<pre><code>"+strings.Join(code, "\n")+"</code></pre>")
+	}
+	closeLists(0)
+	return strings.Join(out, "\n")
+}
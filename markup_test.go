@@ -0,0 +1,112 @@
+package main_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	main "github.com/m-mizutani/GithubEmitter"
+)
+
+func TestMarkdownToJiraWiki(t *testing.T) {
+	md := "## Overview\n" +
+		"\n" +
+		"- Detected by **rule**\n" +
+		"  - source: `10.0.0.1` ([Ref](https://example.com/ref))\n" +
+		"\n" +
+		"```\n" +
+		"{\"a\": `b`}\n" +
+		"```\n" +
+		"\n" +
+		"|Datetime|Type|Vendor|\n" +
+		"|:----|:----|:----|\n" +
+		"|[2018](https://vt.example.com)||Win32|\n" +
+		"\n" +
+		"Time | IP addr\n" +
+		":---:|:------\n" +
+		"10:00 | 10.0.0.2\n" +
+		"\n" +
+		"- - - - -\n" +
+		"text with {braces}"
+
+	wiki := main.MarkdownToJiraWiki(md)
+	assert.Equal(t, "h2. Overview\n"+
+		"\n"+
+		"* Detected by *rule*\n"+
+		"** source: {{10.0.0.1}} ([Ref|https://example.com/ref])\n"+
+		"\n"+
+		"{code}\n"+
+		"{\"a\": `b`}\n"+
+		"{code}\n"+
+		"\n"+
+		"||Datetime||Type||Vendor||\n"+
+		"|[2018|https://vt.example.com]| |Win32|\n"+
+		"\n"+
+		"||Time||IP addr||\n"+
+		"|10:00|10.0.0.2|\n"+
+		"\n"+
+		"----\n"+
+		"text with \\{braces\\}", wiki)
+}
+
+func TestMarkdownToHTML(t *testing.T) {
+	md := "## Overview\n" +
+		"\n" +
+		"- Detected by **rule**\n" +
+		"  - source: `<10.0.0.1>` ([Ref](https://example.com/ref?a=1&b=2))\n" +
+		"- Link: [bad](javascript:alert)\n" +
+		"\n" +
+		"```\n" +
+		"{\"a\": \"<b>\"}\n" +
+		"```\n" +
+		"\n" +
+		"|Datetime|Type|Vendor|\n" +
+		"|:----|:----|:----|\n" +
+		"|[2018](https://vt.example.com)||Win32|\n" +
+		"\n" +
+		"- - - - -\n" +
+		"text & more"
+
+	assert.Equal(t, "<h2>Overview</h2>\n"+
+		"<ul>\n"+
+		"<li>Detected by <strong>rule</strong>\n"+
+		"<ul>\n"+
+		"<li>source: <code>&lt;10.0.0.1&gt;</code> (<a href=\"https://example.com/ref?a=1&amp;b=2\">Ref</a>)\n"+
+		"</li></ul>\n"+
+		"</li>\n"+
+		"<li>Link: bad\n"+
+		"</li></ul>\n"+
+		"<pre><code>{&#34;a&#34;: &#34;&lt;b&gt;&#34;}</code></pre>\n"+
+		"<table>\n"+
+		"<tr><th>Datetime</th><th>Type</th><th>Vendor</th></tr>\n"+
+		"<tr><td><a href=\"https://vt.example.com\">2018</a></td><td></td><td>Win32</td></tr>\n"+
+		"</table>\n"+
+		"<hr>\n"+
+		"<p>text &amp; more</p>", main.MarkdownToHTML(md))
+}
+
+func TestMarkdownToJiraWikiHostile(t *testing.T) {
+	// Untrusted values that body.go writes in Markdown text.
+	cases := map[string]string{
+		"!https://evil.example.com/x.png!": `\!https://evil.example.com/x.png\!`,
+		"a | b":                            `a \| b`,
+		"-deleted-":                        `\-deleted\-`,
+		"+inserted+":                       `\+inserted\+`,
+		"^super^ ~sub~":                    `\^super\^ \~sub\~`,
+		"[click|https://evil.example.com]": `\[click\|https://evil.example.com\]`,
+		"*bold* _em_":                      `\*bold\* \_em\_`,
+		"??cite?? {color:red}x{color}":     `\?\?cite\?\? \{color:red\}x\{color\}`,
+		`line\\break`:                      `line&#92;break`,
+	}
+	for value, expected := range cases {
+		assert.Equal(t, "* Reason: "+expected, main.MarkdownToJiraWiki("- Reason: "+value), value)
+		// Values are escaped by body.go before converted.
+		escaped := main.MarkdownToJiraWiki("- Reason: " + main.EscapeMarkdown(value, main.MarkdownText))
+		assert.NotRegexp(t, `(^|[^\\])[|\[\]*_+^~!{}-]`, escaped[len("* Reason: "):], value)
+	}
+
+	// Only bold and links converted from Markdown are markup.
+	assert.Equal(t, "* *a\\-b* [x\\|y|https://example.com/%5B1%5D]",
+		main.MarkdownToJiraWiki("- **a-b** [x|y](https://example.com/[1])"))
+	assert.Equal(t, "* click", main.MarkdownToJiraWiki("- [click](javascript:alert)"))
+}
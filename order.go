@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// Orders of host and user sections in a published report.
+const (
+	// OrderByKey sorts sections by key (host or user name) lexically.
+	OrderByKey = "key"
+	// OrderByIPAddr sorts sections whose key is an IP address in numeric
+	// order (IPv4 first), and others by key after them.
+	OrderByIPAddr = "ipaddr"
+	// OrderByRelevance sorts sections by number of related malware,
+	// domains, URLs and activities in descending order, and by key on tie.
+	OrderByRelevance = "relevance"
+)
+
+// SectionOrder is ordering of each kind of section. An empty field means
+// the default of the kind, then the zero value is the default ordering.
+type SectionOrder struct {
+	AlliedHost   string
+	OpponentHost string
+	SubjectUser  string
+}
+
+// defaultSectionOrder sorts hosts by IP address and users by name.
+var defaultSectionOrder = SectionOrder{
+	AlliedHost:   OrderByIPAddr,
+	OpponentHost: OrderByIPAddr,
+	SubjectUser:  OrderByKey,
+}
+
+// Validate returns an error if a field is not an order of sections.
+func (x SectionOrder) Validate() error {
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{"allied host", x.AlliedHost},
+		{"opponent host", x.OpponentHost},
+		{"subject user", x.SubjectUser},
+	}
+
+	for _, f := range fields {
+		switch f.value {
+		case "", OrderByKey, OrderByIPAddr, OrderByRelevance:
+		default:
+			return fmt.Errorf("Invalid order of %s section: %s", f.name, f.value)
+		}
+	}
+	return nil
+}
+
+// of returns the order of the kind of sections. An empty field falls back
+// to the default.
+func (x SectionOrder) of(kind string) string {
+	var order, def string
+	switch kind {
+	case sectionAlliedHost:
+		order, def = x.AlliedHost, defaultSectionOrder.AlliedHost
+	case sectionOpponentHost:
+		order, def = x.OpponentHost, defaultSectionOrder.OpponentHost
+	case sectionSubjectUser:
+		order, def = x.SubjectUser, defaultSectionOrder.SubjectUser
+	default:
+		return OrderByKey
+	}
+	if order == "" {
+		return def
+	}
+	return order
+}
+
+// compareIPAddr compares a and b as IP addresses. ok is false if either of
+// them is not an IP address.
+func compareIPAddr(a, b string) (cmp int, ok bool) {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return 0, false
+	}
+
+	v4A, v4B := ipA.To4() != nil, ipB.To4() != nil
+	switch {
+	case v4A && !v4B:
+		return -1, true
+	case !v4A && v4B:
+		return 1, true
+	}
+	return bytes.Compare(ipA.To16(), ipB.To16()), true
+}
+
+// lessValue orders IP addresses numerically before other values, and other
+// values lexically.
+func lessValue(a, b string) bool {
+	if cmp, ok := compareIPAddr(a, b); ok {
+		return cmp < 0
+	}
+
+	isIPA, isIPB := net.ParseIP(a) != nil, net.ParseIP(b) != nil
+	if isIPA != isIPB {
+		return isIPA
+	}
+	return a < b
+}
+
+// uniqueValues returns sorted values without duplication.
+func uniqueValues(values []string) []string {
+	unique := appendUnique(nil, values...)
+	sort.Slice(unique, func(i, j int) bool {
+		return lessValue(unique[i], unique[j])
+	})
+	return unique
+}
+
+func relevance(section reportSection) int {
+	return len(section.Malware) + len(section.Domains) + len(section.URLs) + len(section.Activities)
+}
+
+// sortSections sorts sections of a kind by the order. Keys are unique in a
+// kind, then the result is deterministic.
+func sortSections(sections []reportSection, order string) {
+	sort.Slice(sections, func(i, j int) bool {
+		a, b := sections[i], sections[j]
+		switch order {
+		case OrderByIPAddr:
+			return lessValue(a.Key, b.Key)
+		case OrderByRelevance:
+			if ra, rb := relevance(a), relevance(b); ra != rb {
+				return ra > rb
+			}
+		}
+		return a.Key < b.Key
+	})
+}
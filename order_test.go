@@ -0,0 +1,102 @@
+package main_test
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	main "github.com/m-mizutani/GithubEmitter"
+)
+
+var sectionTitle = regexp.MustCompile(`(?m)^## (.+)$`)
+
+func sectionTitles(body string) []string {
+	titles := []string{}
+	for _, m := range sectionTitle.FindAllStringSubmatch(body, -1) {
+		titles = append(titles, m[1])
+	}
+	return titles
+}
+
+func genOrderReport() ar.Report {
+	report := genDummyReport()
+	mw := report.Content.OpponentHosts["10.0.0.1"].RelatedMalware
+	delete(report.Content.OpponentHosts, "10.0.0.1")
+
+	report.Content.OpponentHosts["10.0.0.10"] = ar.ReportOpponentHost{
+		IPAddr:         []string{"10.0.0.10"},
+		RelatedMalware: mw[:1],
+	}
+	report.Content.OpponentHosts["10.0.0.9"] = ar.ReportOpponentHost{
+		IPAddr: []string{"10.0.0.20", "10.0.0.3", "10.0.0.3", "192.0.2.1"},
+	}
+	report.Content.OpponentHosts["evil.example.com"] = ar.ReportOpponentHost{
+		RelatedMalware: mw,
+	}
+	report.Content.OpponentHosts["2001:db8::1"] = ar.ReportOpponentHost{}
+
+	report.Content.SubjectUsers["mizutani"] = ar.ReportUser{}
+	report.Content.SubjectUsers["alice"] = ar.ReportUser{}
+
+	return report
+}
+
+func TestSectionOrder(t *testing.T) {
+	report := genOrderReport()
+
+	body := main.BuildCommentBody(report, main.SectionOrder{})
+	assert.Equal(t, []string{
+		"Opponent Host: 10.0.0.9",
+		"Opponent Host: 10.0.0.10",
+		"Opponent Host: 2001:db8::1",
+		"Opponent Host: evil.example.com",
+		"Subject User: alice",
+		"Subject User: mizutani",
+	}, sectionTitles(body))
+	assert.Contains(t, body, "- IP address: `10.0.0.3`, `10.0.0.20`, `192.0.2.1`\n")
+
+	// Same report always gets the same body.
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, body, main.BuildCommentBody(report, main.SectionOrder{}))
+	}
+
+	assert.Equal(t, []string{
+		"Opponent Host: evil.example.com",
+		"Opponent Host: 10.0.0.10",
+		"Opponent Host: 10.0.0.9",
+		"Opponent Host: 2001:db8::1",
+		"Subject User: alice",
+		"Subject User: mizutani",
+	}, sectionTitles(main.BuildCommentBody(report, main.SectionOrder{OpponentHost: main.OrderByRelevance})))
+
+	assert.Equal(t, []string{
+		"Opponent Host: 10.0.0.10",
+		"Opponent Host: 10.0.0.9",
+		"Opponent Host: 2001:db8::1",
+		"Opponent Host: evil.example.com",
+		"Subject User: alice",
+		"Subject User: mizutani",
+	}, sectionTitles(main.BuildCommentBody(report, main.SectionOrder{
+		OpponentHost: main.OrderByKey,
+		SubjectUser:  main.OrderByRelevance,
+	})))
+
+	// An order of a sink does not change the others.
+	assert.Equal(t, body, main.BuildCommentBody(report, main.SectionOrder{}))
+	envelope := main.NewWebhookEnvelope(main.WebhookPublished, report, &main.ReportCache{},
+		main.SectionOrder{OpponentHost: main.OrderByRelevance}, time.Now())
+	assert.Equal(t, "Opponent Host: evil.example.com", sectionTitles(envelope.Markdown)[0])
+}
+
+func TestSectionOrderInvalid(t *testing.T) {
+	assert.NoError(t, main.SectionOrder{}.Validate())
+	assert.NoError(t, main.SectionOrder{SubjectUser: main.OrderByRelevance}.Validate())
+
+	err := main.SectionOrder{AlliedHost: "random"}.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "allied host")
+}
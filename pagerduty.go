@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPagerDutyEndpoint = "https://events.pagerduty.com/v2/enqueue"
+	defaultPagerDutyTimeout  = 30 * time.Second
+	defaultPagerDutyMaxRetry = 2 * time.Minute
+
+	// PagerDuty truncates summary longer than 1024 characters.
+	maxPagerDutySummary = 1024
+)
+
+// Event actions of PagerDuty Events API v2.
+const (
+	pagerDutyTrigger     = "trigger"
+	pagerDutyAcknowledge = "acknowledge"
+	pagerDutyResolve     = "resolve"
+)
+
+// Severities of PagerDuty Events API v2.
+const (
+	pagerDutyCritical = "critical"
+	pagerDutyError    = "error"
+	pagerDutyWarning  = "warning"
+	pagerDutyInfo     = "info"
+)
+
+// PagerDutyIncidentKey returns a dedup key of the incident for the report.
+// Events with the same key update one incident instead of paging again.
+func PagerDutyIncidentKey(reportID ar.ReportID) string {
+	return fmt.Sprintf("report/%s", reportID)
+}
+
+// PagerDutyEvent is an event of PagerDuty Events API v2.
+type PagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key,omitempty"`
+	Payload     *PagerDutyPayload `json:"payload,omitempty"`
+	Client      string            `json:"client,omitempty"`
+	ClientURL   string            `json:"client_url,omitempty"`
+	Links       []PagerDutyLink   `json:"links,omitempty"`
+}
+
+// PagerDutyPayload is details of a trigger event.
+type PagerDutyPayload struct {
+	Summary       string                 `json:"summary"`
+	Source        string                 `json:"source"`
+	Severity      string                 `json:"severity"`
+	Timestamp     string                 `json:"timestamp,omitempty"`
+	Component     string                 `json:"component,omitempty"`
+	Group         string                 `json:"group,omitempty"`
+	Class         string                 `json:"class,omitempty"`
+	CustomDetails map[string]interface{} `json:"custom_details,omitempty"`
+}
+
+type PagerDutyLink struct {
+	Href string `json:"href"`
+	Text string `json:"text,omitempty"`
+}
+
+// PagerDutyResponse is a response of accepted event.
+type PagerDutyResponse struct {
+	Status   string `json:"status"`
+	Message  string `json:"message"`
+	DedupKey string `json:"dedup_key"`
+}
+
+// PagerDutyAPIError is an error response of PagerDuty Events API v2.
+type PagerDutyAPIError struct {
+	StatusCode int      `json:"-"`
+	Status     string   `json:"status"`
+	Message    string   `json:"message"`
+	Errors     []string `json:"errors"`
+}
+
+func (x *PagerDutyAPIError) Error() string {
+	msg := fmt.Sprintf("PagerDuty API error (%d)", x.StatusCode)
+	if x.Message != "" {
+		msg += ": " + x.Message
+	}
+	if len(x.Errors) > 0 {
+		msg += " (" + strings.Join(x.Errors, ", ") + ")"
+	}
+	return msg
+}
+
+// Retryable returns true if the event may be accepted by sending again.
+func (x *PagerDutyAPIError) Retryable() bool {
+	return x.StatusCode == http.StatusTooManyRequests || x.StatusCode >= 500
+}
+
+// PagerDuty is a client of PagerDuty Events API v2 for a service.
+type PagerDuty struct {
+	endpoint     string
+	routingKey   string
+	maxRetryTime time.Duration
+	client       *http.Client
+}
+
+// PagerDutyOption is an optional setting of PagerDuty client.
+type PagerDutyOption func(x *PagerDuty)
+
+// WithPagerDutyEndpoint replaces URL of Events API, e.g. for a local stub.
+func WithPagerDutyEndpoint(endpoint string) PagerDutyOption {
+	return func(x *PagerDuty) {
+		x.endpoint = endpoint
+	}
+}
+
+// WithPagerDutyMaxRetryTime sets time limit of retries. Zero disables retry.
+func WithPagerDutyMaxRetryTime(d time.Duration) PagerDutyOption {
+	return func(x *PagerDuty) {
+		x.maxRetryTime = d
+	}
+}
+
+// WithPagerDutyHTTPClient replaces HTTP client to access PagerDuty.
+func WithPagerDutyHTTPClient(client *http.Client) PagerDutyOption {
+	return func(x *PagerDuty) {
+		x.client = client
+	}
+}
+
+// NewPagerDuty returns a client with routing key (integration key) of the
+// service.
+func NewPagerDuty(routingKey string, options ...PagerDutyOption) *PagerDuty {
+	x := &PagerDuty{
+		endpoint:     defaultPagerDutyEndpoint,
+		routingKey:   routingKey,
+		maxRetryTime: defaultPagerDutyMaxRetry,
+		client:       &http.Client{Timeout: defaultPagerDutyTimeout},
+	}
+	for _, opt := range options {
+		opt(x)
+	}
+	return x
+}
+
+// Send sends the event. Routing key of the client is set if the event does
+// not have it. A rejected event is returned as *PagerDutyAPIError. It's
+// retried with exponential backoff on network errors, 429 and 5xx responses
+// because events with the same dedup key are deduplicated by PagerDuty.
+func (x *PagerDuty) Send(ctx context.Context, event PagerDutyEvent) (*PagerDutyResponse, error) {
+	if event.RoutingKey == "" {
+		event.RoutingKey = x.routingKey
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to marshal PagerDuty event")
+	}
+
+	var result PagerDutyResponse
+	operation := func() error {
+		req, err := http.NewRequest("POST", x.endpoint, bytes.NewReader(data))
+		if err != nil {
+			return backoff.Permanent(errors.Wrap(err, "Fail to create PagerDuty request"))
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := x.client.Do(req)
+		if ctx.Err() != nil {
+			return backoff.Permanent(ctx.Err())
+		} else if err != nil {
+			return errors.Wrap(err, "Fail to send PagerDuty event")
+		}
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return errors.Wrap(err, "Fail to read PagerDuty response")
+		}
+		log.WithFields(log.Fields{
+			"action": event.EventAction,
+			"status": resp.StatusCode,
+			"body":   string(body),
+		}).Info("sent a PD event")
+
+		if resp.StatusCode != http.StatusAccepted {
+			apiErr := &PagerDutyAPIError{StatusCode: resp.StatusCode}
+			if err := json.Unmarshal(body, apiErr); err != nil {
+				apiErr.Message = strings.TrimSpace(string(body))
+			}
+			if !apiErr.Retryable() {
+				return backoff.Permanent(apiErr)
+			}
+			return apiErr
+		}
+
+		if err := json.Unmarshal(body, &result); err != nil {
+			return backoff.Permanent(errors.Wrap(err, "Fail to parse PagerDuty response"))
+		}
+		return nil
+	}
+
+	var b backoff.BackOff = &backoff.StopBackOff{}
+	if x.maxRetryTime > 0 {
+		eb := backoff.NewExponentialBackOff()
+		eb.MaxElapsedTime = x.maxRetryTime
+		b = eb
+	}
+
+	notify := func(err error, wait time.Duration) {
+		log.WithError(err).WithField("wait", wait).Warn("Retry PagerDuty event")
+	}
+
+	if err := backoff.RetryNotify(operation, backoff.WithContext(b, ctx), notify); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Trigger opens an incident, or adds the event to the open incident that has
+// the same dedup key.
+func (x *PagerDuty) Trigger(ctx context.Context, dedupKey string, payload PagerDutyPayload, links ...PagerDutyLink) (*PagerDutyResponse, error) {
+	return x.Send(ctx, PagerDutyEvent{
+		EventAction: pagerDutyTrigger,
+		DedupKey:    dedupKey,
+		Payload:     &payload,
+		Links:       links,
+	})
+}
+
+// Acknowledge acknowledges the incident to stop escalation without
+// resolving it.
+func (x *PagerDuty) Acknowledge(ctx context.Context, dedupKey string) (*PagerDutyResponse, error) {
+	return x.Send(ctx, PagerDutyEvent{EventAction: pagerDutyAcknowledge, DedupKey: dedupKey})
+}
+
+// Resolve resolves the incident.
+func (x *PagerDuty) Resolve(ctx context.Context, dedupKey string) (*PagerDutyResponse, error) {
+	return x.Send(ctx, PagerDutyEvent{EventAction: pagerDutyResolve, DedupKey: dedupKey})
+}
+
+// pagerDutySeverity maps severity of a report to one of PagerDuty.
+func pagerDutySeverity(report ar.Report) string {
+	switch report.Result.Severity {
+	case ar.SevUrgent:
+		return pagerDutyCritical
+	case ar.SevUnclassified:
+		return pagerDutyWarning
+	case ar.SevSafe:
+		return pagerDutyInfo
+	default:
+		return pagerDutyError
+	}
+}
+
+// NewPagerDutyPayload builds a payload of trigger event from the report.
+// Source is the first address or domain in alert attributes, and all
+// attributes are put in "attributes" of custom details by key, apart from
+// the report ID and severity.
+func NewPagerDutyPayload(report ar.Report) PagerDutyPayload {
+	summary := []rune(report.Alert.Title())
+	if len(summary) > maxPagerDutySummary {
+		summary = summary[:maxPagerDutySummary]
+	}
+
+	payload := PagerDutyPayload{
+		Summary:   string(summary),
+		Source:    "GheReporter",
+		Severity:  pagerDutySeverity(report),
+		Component: report.Alert.Rule,
+		Class:     report.Alert.Name,
+		CustomDetails: map[string]interface{}{
+			"report_id": string(report.ID),
+			"severity":  string(report.Result.Severity),
+		},
+	}
+	if report.Result.Reason != "" {
+		payload.CustomDetails["reason"] = report.Result.Reason
+	}
+	if report.Alert.Timestamp.Init > 0 {
+		payload.Timestamp = time.Unix(int64(report.Alert.Timestamp.Init), 0).UTC().Format(time.RFC3339)
+	}
+
+	sourceFound := false
+	keys := []string{}
+	values := map[string][]interface{}{}
+	for _, attr := range report.Alert.Attrs {
+		if !sourceFound && (attr.Type == "ipaddr" || attr.Type == "domain") && attr.Value != "" {
+			payload.Source = attr.Value
+			sourceFound = true
+		}
+
+		var value interface{} = attr.Value
+		if attr.Type == "json" {
+			var v interface{}
+			if err := json.Unmarshal([]byte(attr.Value), &v); err == nil {
+				value = v
+			}
+		}
+
+		if _, ok := values[attr.Key]; !ok {
+			keys = append(keys, attr.Key)
+		}
+		values[attr.Key] = append(values[attr.Key], value)
+	}
+
+	// Attributes can have the same key, then they are put as a list.
+	attrs := map[string]interface{}{}
+	for _, key := range keys {
+		if len(values[key]) == 1 {
+			attrs[key] = values[key][0]
+		} else {
+			attrs[key] = values[key]
+		}
+	}
+	if len(attrs) > 0 {
+		payload.CustomDetails["attributes"] = attrs
+	}
+
+	return payload
+}
+
+// PagerDutySink triggers a PagerDuty incident when a report is published
+// with severity other than safe, and resolves it when the report becomes
+// safe. The incident is deduplicated by ReportID, then repeated publishes
+// update one incident by triggering it again with the same key. A report
+// downgraded from urgent acknowledges the incident instead, and it is
+// triggered again only when the report escalates to urgent. Paging policy
+// decides whether a report pages.
+type PagerDutySink struct {
+	pagerDuty *PagerDuty
+	policy    *PagingPolicy
+}
+
+// NewPagerDutySink returns a sink for PagerDuty. nil policy pages for all
+// reports other than safe.
+func NewPagerDutySink(pagerDuty *PagerDuty, policy *PagingPolicy) *PagerDutySink {
+	return &PagerDutySink{pagerDuty: pagerDuty, policy: policy}
+}
+
+func (x *PagerDutySink) Name() string { return "pagerduty" }
+
+func (x *PagerDutySink) Create(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	return nil, nil
+}
+
+func (x *PagerDutySink) Update(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	return nil, nil
+}
+
+func (x *PagerDutySink) Comment(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	if report.Result.Severity == ar.SevSafe {
+		return nil, nil
+	}
+
+	key := PagerDutyIncidentKey(report.ID)
+	decision := x.policy.Decide(report, time.Now())
+	log.WithFields(log.Fields{
+		"report":   report.ID,
+		"decision": decision,
+	}).Info("paging decision")
+
+	urgent := report.Result.Severity == ar.SevUrgent
+	switch {
+	case cache.PagerDutyState == pagerDutyTrigger && cache.PagerDutySeverity == string(ar.SevUrgent) && !urgent:
+		// Downgraded from urgent, then stop paging but keep the incident.
+		if _, err := x.pagerDuty.Acknowledge(ctx, key); err != nil {
+			return nil, errors.Wrap(err, "Fail to acknowledge PagerDuty incident")
+		}
+		cache.PagerDutyState = pagerDutyAcknowledge
+		cache.PagerDutySeverity = string(report.Result.Severity)
+		return &SinkResult{Sink: x.Name(), Action: sinkComment, HtmlURL: cache.commentLink(), Paging: &decision}, nil
+	case cache.PagerDutyState == pagerDutyAcknowledge && !urgent:
+		// Someone is working on the incident, then not to page again
+		// unless the report escalates to urgent.
+		decision.Page = false
+		decision.Reason = "incident is acknowledged"
+		return &SinkResult{Sink: x.Name(), Action: sinkSkip, Paging: &decision}, nil
+	case !decision.Page && cache.PagerDutyState != pagerDutyTrigger:
+		// An open incident is updated by the same dedup key even if the
+		// policy does not page for the report, because it does not page
+		// again.
+		return &SinkResult{Sink: x.Name(), Action: sinkSkip, Paging: &decision}, nil
+	}
+
+	// The published report is linked as the incident of the original
+	// integration did.
+	var links []PagerDutyLink
+	if link := cache.commentLink(); link != "" {
+		links = append(links, PagerDutyLink{Href: link, Text: "Report"})
+	}
+	if _, err := x.pagerDuty.Trigger(ctx, key, NewPagerDutyPayload(report), links...); err != nil {
+		return nil, errors.Wrap(err, "Fail to trigger PagerDuty incident")
+	}
+	cache.PagerDutyState = pagerDutyTrigger
+	cache.PagerDutySeverity = string(report.Result.Severity)
+
+	return &SinkResult{Sink: x.Name(), Action: sinkComment, HtmlURL: cache.commentLink(), Paging: &decision}, nil
+}
+
+func (x *PagerDutySink) Resolve(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	if cache.PagerDutyState == "" || cache.PagerDutyState == pagerDutyResolve {
+		return nil, nil
+	}
+
+	if _, err := x.pagerDuty.Resolve(ctx, PagerDutyIncidentKey(report.ID)); err != nil {
+		return nil, errors.Wrap(err, "Fail to resolve PagerDuty incident")
+	}
+	cache.PagerDutyState = pagerDutyResolve
+
+	return &SinkResult{Sink: x.Name(), Action: sinkResolve, HtmlURL: cache.issueLink()}, nil
+}
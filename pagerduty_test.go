@@ -0,0 +1,262 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	main "github.com/m-mizutani/GithubEmitter"
+)
+
+// fakePagerDuty is a stub of PagerDuty Events API v2 that records events.
+type fakePagerDuty struct {
+	fakeServer
+	events []map[string]interface{}
+	// failures is number of requests to fail with 503 before success.
+	failures int
+}
+
+func newFakePagerDuty() *fakePagerDuty {
+	x := &fakePagerDuty{}
+	x.start(func(w http.ResponseWriter, r *http.Request) {
+		var event map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if event["routing_key"] == "invalid" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"status":"invalid event","message":"Event object is invalid","errors":["Length of 'routing_key' is incorrect"]}`))
+			return
+		}
+
+		if x.failures > 0 {
+			x.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		x.events = append(x.events, event)
+
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":    "success",
+			"message":   "Event processed",
+			"dedup_key": event["dedup_key"],
+		})
+	})
+	return x
+}
+
+func (x *fakePagerDuty) actions() []string {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	actions := []string{}
+	for _, ev := range x.events {
+		actions = append(actions, ev["event_action"].(string))
+	}
+	return actions
+}
+
+func TestPagerDutyTrigger(t *testing.T) {
+	fake := newFakePagerDuty()
+	defer fake.Close()
+	pd := main.NewPagerDuty("xxx", main.WithPagerDutyEndpoint(fake.server.URL))
+
+	report := genDummyReport()
+	report.Result.Severity = ar.SevUrgent
+	payload := main.NewPagerDutyPayload(report)
+	assert.Equal(t, "critical", payload.Severity)
+	assert.Equal(t, "10.0.0.1", payload.Source)
+	assert.Equal(t, "I am a rule", payload.Component)
+	assert.Equal(t, "10.0.0.1", payload.CustomDetails["attributes"].(map[string]interface{})["source address"])
+
+	// An attribute can not overwrite the report ID or severity, and an empty
+	// address is not a source.
+	report.Alert.Attrs = []ar.Attribute{
+		{Type: "ipaddr", Key: "empty", Value: ""},
+		{Type: "domain", Key: "report_id", Value: "evil.example.com"},
+		{Type: "", Key: "severity", Value: "safe"},
+	}
+	other := main.NewPagerDutyPayload(report)
+	assert.Equal(t, "evil.example.com", other.Source)
+	assert.Equal(t, string(report.ID), other.CustomDetails["report_id"])
+	assert.Equal(t, "urgent", other.CustomDetails["severity"])
+	assert.Equal(t, "evil.example.com", other.CustomDetails["attributes"].(map[string]interface{})["report_id"])
+
+	resp, err := pd.Trigger(context.Background(), "report/1", payload,
+		main.PagerDutyLink{Href: "https://example.com/issues/1", Text: "Issue"})
+	require.NoError(t, err)
+	assert.Equal(t, "report/1", resp.DedupKey)
+
+	require.Equal(t, 1, len(fake.events))
+	ev := fake.events[0]
+	assert.Equal(t, "xxx", ev["routing_key"])
+	assert.Equal(t, "trigger", ev["event_action"])
+	assert.Equal(t, "critical", ev["payload"].(map[string]interface{})["severity"])
+	assert.Equal(t, "https://example.com/issues/1", ev["links"].([]interface{})[0].(map[string]interface{})["href"])
+}
+
+func TestPagerDutyRetry(t *testing.T) {
+	fake := newFakePagerDuty()
+	defer fake.Close()
+	fake.failures = 2
+	pd := main.NewPagerDuty("xxx", main.WithPagerDutyEndpoint(fake.server.URL),
+		main.WithPagerDutyMaxRetryTime(10*time.Second))
+
+	_, err := pd.Resolve(context.Background(), "report/1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"resolve"}, fake.actions())
+
+	// Retry is disabled by zero.
+	fake.failures = 1
+	pd = main.NewPagerDuty("xxx", main.WithPagerDutyEndpoint(fake.server.URL),
+		main.WithPagerDutyMaxRetryTime(0))
+	_, err = pd.Resolve(context.Background(), "report/1")
+	require.Error(t, err)
+	apiErr, ok := err.(*main.PagerDutyAPIError)
+	require.True(t, ok)
+	assert.True(t, apiErr.Retryable())
+}
+
+func TestPagerDutyAPIError(t *testing.T) {
+	fake := newFakePagerDuty()
+	defer fake.Close()
+	pd := main.NewPagerDuty("invalid", main.WithPagerDutyEndpoint(fake.server.URL))
+
+	_, err := pd.Resolve(context.Background(), "report/1")
+	require.Error(t, err)
+	apiErr, ok := err.(*main.PagerDutyAPIError)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	assert.Equal(t, "Event object is invalid", apiErr.Message)
+	assert.Equal(t, 1, len(apiErr.Errors))
+	assert.False(t, apiErr.Retryable())
+}
+
+func TestPagerDutySink(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakePagerDuty()
+	defer fake.Close()
+	sink := main.NewPagerDutySink(main.NewPagerDuty("xxx", main.WithPagerDutyEndpoint(fake.server.URL)), nil)
+
+	report := genDummyReport()
+	report.Status = ar.StatusPublished
+	cache := main.ReportCache{
+		ReportID:       report.ID,
+		HtmlURL:        "https://example.com/issues/1",
+		CommentHtmlURL: "https://example.com/issues/1#issuecomment-2",
+	}
+
+	// Repeated publishes update one incident.
+	report.Result.Severity = ar.SevUrgent
+	_, err := sink.Comment(ctx, report, &cache)
+	require.NoError(t, err)
+	_, err = sink.Comment(ctx, report, &cache)
+	require.NoError(t, err)
+
+	// Downgraded report acknowledges the incident only once.
+	report.Result.Severity = ar.SevUnclassified
+	_, err = sink.Comment(ctx, report, &cache)
+	require.NoError(t, err)
+	res, err := sink.Comment(ctx, report, &cache)
+	require.NoError(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, "skip", res.Action)
+	require.NotNil(t, res.Paging)
+	assert.False(t, res.Paging.Page)
+	assert.Equal(t, "incident is acknowledged", res.Paging.Reason)
+
+	report.Result.Severity = ar.SevSafe
+	_, err = sink.Resolve(ctx, report, &cache)
+	require.NoError(t, err)
+	res, err = sink.Resolve(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+
+	assert.Equal(t, []string{"trigger", "trigger", "acknowledge", "resolve"}, fake.actions())
+	// The incident links the published report.
+	link := fake.events[0]["links"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, cache.CommentHtmlURL, link["href"])
+	for _, ev := range fake.events {
+		assert.Equal(t, main.PagerDutyIncidentKey(report.ID), ev["dedup_key"])
+	}
+}
+
+func TestPagerDutySinkSeverityChange(t *testing.T) {
+	ctx := context.Background()
+
+	publish := func(severities ...ar.ReportSeverity) (*fakePagerDuty, main.ReportCache) {
+		fake := newFakePagerDuty()
+		sink := main.NewPagerDutySink(main.NewPagerDuty("xxx", main.WithPagerDutyEndpoint(fake.server.URL)), nil)
+		report := genDummyReport()
+		report.Status = ar.StatusPublished
+		cache := main.ReportCache{ReportID: report.ID}
+		for _, sev := range severities {
+			report.Result.Severity = sev
+			_, err := sink.Comment(ctx, report, &cache)
+			require.NoError(t, err)
+		}
+		return fake, cache
+	}
+
+	t.Run("urgent to urgent", func(t *testing.T) {
+		fake, cache := publish(ar.SevUrgent, ar.SevUrgent)
+		defer fake.Close()
+		assert.Equal(t, []string{"trigger", "trigger"}, fake.actions())
+		assert.Equal(t, "trigger", cache.PagerDutyState)
+	})
+
+	t.Run("urgent to unclassified", func(t *testing.T) {
+		fake, cache := publish(ar.SevUrgent, ar.SevUnclassified, ar.SevUnclassified)
+		defer fake.Close()
+		assert.Equal(t, []string{"trigger", "acknowledge"}, fake.actions())
+		assert.Equal(t, "acknowledge", cache.PagerDutyState)
+		assert.Equal(t, "unclassified", cache.PagerDutySeverity)
+	})
+
+	t.Run("urgent to urgent without paging", func(t *testing.T) {
+		fake := newFakePagerDuty()
+		defer fake.Close()
+		policy := &main.PagingPolicy{}
+		sink := main.NewPagerDutySink(main.NewPagerDuty("xxx", main.WithPagerDutyEndpoint(fake.server.URL)), policy)
+		report := genDummyReport()
+		report.Status = ar.StatusPublished
+		report.Result.Severity = ar.SevUrgent
+		cache := main.ReportCache{ReportID: report.ID}
+
+		_, err := sink.Comment(ctx, report, &cache)
+		require.NoError(t, err)
+		// The policy stops paging for the rule, but the open incident is
+		// updated instead of acknowledged.
+		policy.Rules = []main.PagingRule{{Disabled: true}}
+		_, err = sink.Comment(ctx, report, &cache)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"trigger", "trigger"}, fake.actions())
+		assert.Equal(t, "trigger", cache.PagerDutyState)
+	})
+
+	t.Run("unclassified to unclassified", func(t *testing.T) {
+		// Not a downgrade, then the incident is triggered again.
+		fake, _ := publish(ar.SevUnclassified, ar.SevUnclassified)
+		defer fake.Close()
+		assert.Equal(t, []string{"trigger", "trigger"}, fake.actions())
+	})
+
+	t.Run("acknowledged to urgent", func(t *testing.T) {
+		fake, cache := publish(ar.SevUrgent, ar.SevUnclassified, ar.SevUrgent)
+		defer fake.Close()
+		assert.Equal(t, []string{"trigger", "acknowledge", "trigger"}, fake.actions())
+		assert.Equal(t, "trigger", cache.PagerDutyState)
+		assert.Equal(t, "urgent", cache.PagerDutySeverity)
+		for _, ev := range fake.events {
+			assert.Equal(t, main.PagerDutyIncidentKey(cache.ReportID), ev["dedup_key"])
+		}
+	})
+}
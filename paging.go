@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	log "github.com/sirupsen/logrus"
+)
+
+// severityRank orders severities of reports. Unknown severity is ranked as
+// unclassified.
+func severityRank(severity string) int {
+	switch severity {
+	case string(ar.SevSafe):
+		return 0
+	case string(ar.SevUrgent):
+		return 2
+	default:
+		return 1
+	}
+}
+
+// PagingRule decides whether a report of the rule pages on-call. Empty Rule
+// is the default for rules without their own PagingRule.
+type PagingRule struct {
+	Rule string `json:"rule,omitempty"`
+	// Disabled opts out of paging for the rule.
+	Disabled bool `json:"disabled,omitempty"`
+	// MinSeverity is the lowest severity to page, e.g. "urgent".
+	MinSeverity string `json:"min_severity,omitempty"`
+	// OffHoursMinSeverity replaces MinSeverity out of business hours. Empty
+	// means the same as MinSeverity.
+	OffHoursMinSeverity string `json:"off_hours_min_severity,omitempty"`
+}
+
+// BusinessHours is a weekly schedule of business hours. A day is from
+// StartHour to EndHour (exclusive) in the time zone. Weekdays are short
+// names like "Mon" and Monday to Friday by default.
+type BusinessHours struct {
+	Timezone  string   `json:"timezone,omitempty"`
+	StartHour int      `json:"start_hour"`
+	EndHour   int      `json:"end_hour"`
+	Weekdays  []string `json:"weekdays,omitempty"`
+}
+
+var defaultWeekdays = []string{"Mon", "Tue", "Wed", "Thu", "Fri"}
+
+// Contains returns true if t is in business hours.
+func (x *BusinessHours) Contains(t time.Time) bool {
+	loc, err := time.LoadLocation(x.Timezone)
+	if err != nil {
+		log.WithError(err).WithField("timezone", x.Timezone).Warn("Invalid timezone, use UTC")
+		loc = time.UTC
+	}
+	t = t.In(loc)
+
+	weekdays := x.Weekdays
+	if len(weekdays) == 0 {
+		weekdays = defaultWeekdays
+	}
+	workday := false
+	for _, d := range weekdays {
+		if strings.EqualFold(d, t.Weekday().String()[:3]) {
+			workday = true
+			break
+		}
+	}
+
+	return workday && x.StartHour <= t.Hour() && t.Hour() < x.EndHour
+}
+
+// PagingPolicy decides whether a published report pages on-call. Without
+// any rule, a report with severity other than safe pages.
+type PagingPolicy struct {
+	Rules []PagingRule `json:"rules,omitempty"`
+	// BusinessHours enables OffHoursMinSeverity of rules if set.
+	BusinessHours *BusinessHours `json:"business_hours,omitempty"`
+}
+
+// PagingDecision is a result of PagingPolicy for a report.
+type PagingDecision struct {
+	Page     bool   `json:"page"`
+	Reason   string `json:"reason"`
+	Rule     string `json:"rule,omitempty"`
+	OffHours bool   `json:"off_hours"`
+}
+
+// Validate returns an error if the policy has an unknown severity, e.g. a
+// misspelled min_severity that would page for all reports.
+func (x *PagingPolicy) Validate() error {
+	if x == nil {
+		return nil
+	}
+
+	for _, rule := range x.Rules {
+		for _, severity := range []string{rule.MinSeverity, rule.OffHoursMinSeverity} {
+			switch severity {
+			case "", string(ar.SevSafe), string(ar.SevUnclassified), string(ar.SevUrgent):
+			default:
+				return fmt.Errorf("Invalid severity of paging rule %q: %s", rule.Rule, severity)
+			}
+		}
+	}
+	return nil
+}
+
+func (x *PagingPolicy) rule(report ar.Report) (PagingRule, bool) {
+	var fallback *PagingRule
+	for i, rule := range x.Rules {
+		if rule.Rule == report.Alert.Rule {
+			return rule, true
+		}
+		if rule.Rule == "" && fallback == nil {
+			fallback = &x.Rules[i]
+		}
+	}
+
+	if fallback != nil {
+		return *fallback, true
+	}
+	return PagingRule{}, false
+}
+
+// Decide returns whether the report pages at the time.
+func (x *PagingPolicy) Decide(report ar.Report, now time.Time) PagingDecision {
+	severity := string(report.Result.Severity)
+	if severity == string(ar.SevSafe) {
+		return PagingDecision{Reason: "safe report"}
+	}
+
+	var decision PagingDecision
+	var rule PagingRule
+	var found bool
+	if x != nil {
+		rule, found = x.rule(report)
+		if x.BusinessHours != nil {
+			decision.OffHours = !x.BusinessHours.Contains(now)
+		}
+	}
+	if !found {
+		decision.Page = true
+		decision.Reason = "no paging rule"
+		return decision
+	}
+	decision.Rule = rule.Rule
+
+	if rule.Disabled {
+		decision.Reason = "paging is disabled for the rule"
+		return decision
+	}
+
+	minSeverity := rule.MinSeverity
+	if decision.OffHours && rule.OffHoursMinSeverity != "" {
+		minSeverity = rule.OffHoursMinSeverity
+	}
+	if minSeverity == "" {
+		minSeverity = string(ar.SevUnclassified)
+	}
+
+	decision.Page = severityRank(severity) >= severityRank(minSeverity)
+	if decision.Page {
+		decision.Reason = fmt.Sprintf("severity %s is %s or higher", severity, minSeverity)
+	} else {
+		decision.Reason = fmt.Sprintf("severity %s is lower than %s", severity, minSeverity)
+	}
+	return decision
+}
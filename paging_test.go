@@ -0,0 +1,122 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	main "github.com/m-mizutani/GithubEmitter"
+)
+
+func TestPagingPolicy(t *testing.T) {
+	policy := &main.PagingPolicy{
+		Rules: []main.PagingRule{
+			{MinSeverity: "urgent"},
+			{Rule: "noisy rule", Disabled: true},
+			{Rule: "I am a rule", MinSeverity: "unclassified", OffHoursMinSeverity: "urgent"},
+		},
+		BusinessHours: &main.BusinessHours{
+			Timezone:  "UTC",
+			StartHour: 9,
+			EndHour:   18,
+		},
+	}
+	// 2018-06-04 is Monday.
+	workTime := time.Date(2018, 6, 4, 10, 0, 0, 0, time.UTC)
+	night := time.Date(2018, 6, 4, 22, 0, 0, 0, time.UTC)
+	weekend := time.Date(2018, 6, 2, 10, 0, 0, 0, time.UTC)
+
+	report := genDummyReport()
+	report.Result.Severity = ar.SevUnclassified
+
+	d := policy.Decide(report, workTime)
+	assert.True(t, d.Page)
+	assert.False(t, d.OffHours)
+	assert.Equal(t, "I am a rule", d.Rule)
+
+	d = policy.Decide(report, night)
+	assert.False(t, d.Page)
+	assert.True(t, d.OffHours)
+	assert.False(t, policy.Decide(report, weekend).Page)
+
+	report.Result.Severity = ar.SevUrgent
+	assert.True(t, policy.Decide(report, night).Page)
+
+	// Default rule
+	report.Alert.Rule = "other rule"
+	assert.True(t, policy.Decide(report, workTime).Page)
+	report.Result.Severity = ar.SevUnclassified
+	d = policy.Decide(report, workTime)
+	assert.False(t, d.Page)
+	assert.Equal(t, "", d.Rule)
+
+	// Opt-out
+	report.Alert.Rule = "noisy rule"
+	report.Result.Severity = ar.SevUrgent
+	d = policy.Decide(report, workTime)
+	assert.False(t, d.Page)
+	assert.Equal(t, "noisy rule", d.Rule)
+
+	report.Result.Severity = ar.SevSafe
+	assert.False(t, policy.Decide(report, workTime).Page)
+}
+
+func TestPagingPolicyValidate(t *testing.T) {
+	var policy *main.PagingPolicy
+	assert.NoError(t, policy.Validate())
+
+	policy = &main.PagingPolicy{Rules: []main.PagingRule{
+		{MinSeverity: "urgent"},
+		{Rule: "noisy rule", MinSeverity: "unclassified", OffHoursMinSeverity: "safe"},
+	}}
+	assert.NoError(t, policy.Validate())
+
+	policy.Rules[1].OffHoursMinSeverity = "urgnet"
+	err := policy.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "noisy rule")
+	assert.Contains(t, err.Error(), "urgnet")
+
+	var loaded main.PagingPolicy
+	require.NoError(t, json.Unmarshal([]byte(`{"rules":[{"min_severity":"Urgent"}]}`), &loaded))
+	assert.Error(t, loaded.Validate())
+}
+
+func TestPagingPolicyNil(t *testing.T) {
+	var policy *main.PagingPolicy
+	report := genDummyReport()
+	report.Result.Severity = ar.SevUnclassified
+	assert.True(t, policy.Decide(report, time.Now()).Page)
+}
+
+func TestPagerDutySinkPolicy(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakePagerDuty()
+	defer fake.Close()
+	policy := &main.PagingPolicy{Rules: []main.PagingRule{{MinSeverity: "urgent"}}}
+	sink := main.NewPagerDutySink(main.NewPagerDuty("xxx", main.WithPagerDutyEndpoint(fake.server.URL)), policy)
+
+	report := genDummyReport()
+	report.Status = ar.StatusPublished
+	report.Result.Severity = ar.SevUnclassified
+	cache := main.ReportCache{ReportID: report.ID}
+
+	res, err := sink.Comment(ctx, report, &cache)
+	require.NoError(t, err)
+	require.NotNil(t, res)
+	assert.Equal(t, "skip", res.Action)
+	require.NotNil(t, res.Paging)
+	assert.False(t, res.Paging.Page)
+	assert.Equal(t, 0, len(fake.actions()))
+
+	report.Result.Severity = ar.SevUrgent
+	res, err = sink.Comment(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.True(t, res.Paging.Page)
+	assert.Equal(t, []string{"trigger"}, fake.actions())
+}
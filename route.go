@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+)
+
+// RouteRule maps a report to a GitHub repository, assignees and mentions.
+// All conditions set in the rule must match, and a rule without conditions
+// matches any report. AttrKey, AttrValue and AttrContext are tested with the
+// same attribute.
+type RouteRule struct {
+	Rule        string `json:"rule,omitempty"`
+	AttrKey     string `json:"attr_key,omitempty"`
+	AttrValue   string `json:"attr_value,omitempty"`
+	AttrContext string `json:"attr_context,omitempty"`
+	Severity    string `json:"severity,omitempty"`
+
+	// Repository, Endpoint and Token are destination of the issue. Endpoint
+	// and Token are optional and the default ones are used if empty.
+	Repository string `json:"repository,omitempty"`
+	Endpoint   string `json:"endpoint,omitempty"`
+	Token      string `json:"token,omitempty"`
+
+	Assignees []string `json:"assignees,omitempty"`
+	// Mentions are users or teams (e.g. "@org/team") written in CC line of
+	// the issue.
+	Mentions []string `json:"mentions,omitempty"`
+}
+
+func hasContext(attr ar.Attribute, context string) bool {
+	for _, c := range attr.Context {
+		if c == context {
+			return true
+		}
+	}
+	return false
+}
+
+func (x RouteRule) match(report ar.Report) bool {
+	if x.Rule != "" && x.Rule != report.Alert.Rule {
+		return false
+	}
+	if x.Severity != "" && x.Severity != string(report.Result.Severity) {
+		return false
+	}
+	if x.AttrKey == "" && x.AttrValue == "" && x.AttrContext == "" {
+		return true
+	}
+
+	for _, attr := range report.Alert.Attrs {
+		if (x.AttrKey == "" || x.AttrKey == attr.Key) &&
+			(x.AttrValue == "" || x.AttrValue == attr.Value) &&
+			(x.AttrContext == "" || hasContext(attr, x.AttrContext)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Route is a destination of a report decided by route rules. Empty
+// Repository and Endpoint mean the default ones.
+type Route struct {
+	Repository string
+	Endpoint   string
+	Assignees  []string
+	Mentions   []string
+}
+
+// Router decides a route of a report by route rules.
+type Router struct {
+	rules []RouteRule
+}
+
+// NewRouter returns a router with the rules. The first matched rule with
+// Repository decides the repository. Assignees and mentions of all matched
+// rules are merged in order of the rules.
+func NewRouter(rules []RouteRule) *Router {
+	return &Router{rules: rules}
+}
+
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, s := range list {
+			if s == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// Route returns repository, assignees and mentions for the report.
+func (x *Router) Route(report ar.Report) Route {
+	var route Route
+	if x == nil {
+		return route
+	}
+
+	for _, rule := range x.rules {
+		if !rule.match(report) {
+			continue
+		}
+
+		if route.Repository == "" && rule.Repository != "" {
+			route.Repository = rule.Repository
+			route.Endpoint = rule.Endpoint
+		}
+
+		for _, assignee := range rule.Assignees {
+			route.Assignees = appendUnique(route.Assignees, strings.TrimPrefix(assignee, "@"))
+		}
+		for _, mention := range rule.Mentions {
+			if !strings.HasPrefix(mention, "@") {
+				mention = "@" + mention
+			}
+			route.Mentions = appendUnique(route.Mentions, mention)
+		}
+	}
+
+	return route
+}
+
+func containsString(list []string, value string) bool {
+	for _, s := range list {
+		if s == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package main_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	main "github.com/m-mizutani/GithubEmitter"
+)
+
+func TestRouter(t *testing.T) {
+	router := main.NewRouter([]main.RouteRule{
+		{Rule: "I am a rule", Assignees: []string{"alice"}, Mentions: []string{"org/blue"}},
+		{AttrKey: "source address", AttrValue: "10.0.0.1", Assignees: []string{"@bob", "alice"}},
+		{AttrKey: "source address", AttrValue: "10.0.0.2", Assignees: []string{"carol"}},
+		{Severity: "urgent", Mentions: []string{"@org/oncall"}},
+	})
+
+	report := genDummyReport()
+	route := router.Route(report)
+	assert.Equal(t, []string{"alice", "bob"}, route.Assignees)
+	assert.Equal(t, []string{"@org/blue"}, route.Mentions)
+
+	report.Result.Severity = ar.SevUrgent
+	route = router.Route(report)
+	assert.Equal(t, []string{"@org/blue", "@org/oncall"}, route.Mentions)
+
+	report.Alert.Rule = "other"
+	report.Alert.Attrs = nil
+	route = router.Route(report)
+	assert.Equal(t, 0, len(route.Assignees))
+	assert.Equal(t, []string{"@org/oncall"}, route.Mentions)
+}
+
+func TestRouterRepository(t *testing.T) {
+	router := main.NewRouter([]main.RouteRule{
+		{Rule: "other", Repository: "green/seven"},
+		{AttrContext: "remote", Repository: "red/six", Endpoint: "https://ghe.example.com/api/v3"},
+		{Rule: "I am a rule", Repository: "blue/five"},
+	})
+
+	report := genDummyReport()
+	route := router.Route(report)
+	assert.Equal(t, "red/six", route.Repository)
+	assert.Equal(t, "https://ghe.example.com/api/v3", route.Endpoint)
+
+	report.Alert.Attrs[0].Context = []string{"local"}
+	route = router.Route(report)
+	assert.Equal(t, "blue/five", route.Repository)
+	assert.Equal(t, "", route.Endpoint)
+}
+
+func TestRouterNoRule(t *testing.T) {
+	var router *main.Router
+	route := router.Route(genDummyReport())
+	assert.Equal(t, 0, len(route.Assignees))
+	assert.Equal(t, 0, len(route.Mentions))
+}
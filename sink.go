@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+)
+
+const (
+	sinkCreate  = "create"
+	sinkUpdate  = "update"
+	sinkComment = "comment"
+	sinkResolve = "resolve"
+	// sinkSkip means that a sink decided not to act, e.g. by paging policy.
+	sinkSkip = "skip"
+)
+
+// Sink is a destination of reports. Emitter calls Create when a report
+// arrives for the first time, Update when a known report gets a new alert,
+// Comment when the report is published and Resolve when it is published as
+// safe. A sink can keep its own state (e.g. URL of the issue) in the cache.
+// A sink returns nil result if it did nothing for the action.
+type Sink interface {
+	Name() string
+	Create(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error)
+	Update(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error)
+	Comment(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error)
+	Resolve(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error)
+}
+
+// Recoverer is a sink that can rebuild its state in the cache by looking
+// up the destination when the cache record is lost or expired. Recover
+// returns false if the report is not found in the destination.
+type Recoverer interface {
+	Recover(ctx context.Context, report ar.Report, cache *ReportCache) (bool, error)
+}
+
+// SinkResult is a result of an action of a sink.
+type SinkResult struct {
+	Sink    string `json:"sink"`
+	Action  string `json:"action"`
+	ApiURL  string `json:"api_url,omitempty"`
+	HtmlURL string `json:"html_url,omitempty"`
+
+	// Paging is the decision of paging policy by PagerDutySink.
+	Paging *PagingDecision `json:"paging,omitempty"`
+}
+
+// SinkError is an error of an action of a sink.
+type SinkError struct {
+	Sink   string
+	Action string
+	Err    error
+}
+
+func (x *SinkError) Error() string {
+	return fmt.Sprintf("Fail to %s report by %s: %s", x.Action, x.Sink, x.Err)
+}
+
+// Cause returns the error of the sink for errors.Cause.
+func (x *SinkError) Cause() error { return x.Err }
+
+// SinkErrors is errors of sinks in an emit.
+type SinkErrors []*SinkError
+
+func (x SinkErrors) Error() string {
+	msgs := make([]string, len(x))
+	for i, err := range x {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (x SinkErrors) failed(sink string) bool {
+	for _, err := range x {
+		if err.Sink == sink {
+			return true
+		}
+	}
+	return false
+}
+
+// newSinks builds sinks configured by secret values. GitHub is optional if
+// GitLab or Jira is configured. Sections of published reports are sorted by
+// the order.
+func newSinks(secrets secretValues, order SectionOrder) ([]Sink, error) {
+	var sinks []Sink
+
+	if secrets.GithubRepository != "" || (secrets.GitLabProject == "" && secrets.JiraProject == "") {
+		sink, err := newGitHubSink(secrets)
+		if err != nil {
+			return nil, err
+		}
+		sink.SectionOrder = order
+		sinks = append(sinks, sink)
+	}
+	if secrets.GitLabEndpoint != "" && secrets.GitLabProject != "" {
+		gitlab := NewGitLab(secrets.GitLabEndpoint, secrets.GitLabProject, secrets.GitLabToken)
+		sink := NewGitLabSink(gitlab)
+		sink.SectionOrder = order
+		sinks = append(sinks, sink)
+	}
+	if secrets.JiraEndpoint != "" && secrets.JiraProject != "" {
+		var options []JiraOption
+		if secrets.JiraUser != "" {
+			options = append(options, WithJiraUser(secrets.JiraUser))
+		}
+		if secrets.JiraIssueType != "" {
+			options = append(options, WithJiraIssueType(secrets.JiraIssueType))
+		}
+		jira := NewJira(secrets.JiraEndpoint, secrets.JiraProject, secrets.JiraToken, options...)
+		sink := NewJiraSink(jira, secrets.JiraPriorities)
+		sink.SectionOrder = order
+		sinks = append(sinks, sink)
+	}
+	if secrets.PagerDutyToken != "" {
+		if err := secrets.PagingPolicy.Validate(); err != nil {
+			return nil, errors.Wrap(err, "Fail to load paging policy")
+		}
+
+		var options []PagerDutyOption
+		if secrets.PagerDutyEndpoint != "" {
+			options = append(options, WithPagerDutyEndpoint(secrets.PagerDutyEndpoint))
+		}
+		pd := NewPagerDuty(secrets.PagerDutyToken, options...)
+		sinks = append(sinks, NewPagerDutySink(pd, secrets.PagingPolicy))
+	}
+	if secrets.SlackToken != "" {
+		sinks = append(sinks, NewSlackSink(NewSlack(secrets.SlackToken), secrets.SlackChannel))
+	}
+	if secrets.TeamsAppID != "" && secrets.TeamsConversationID != "" {
+		teams := NewTeams(secrets.TeamsAppID, secrets.TeamsAppPassword,
+			secrets.TeamsServiceURL, secrets.TeamsConversationID)
+		sink := NewTeamsSink(teams)
+		sink.SectionOrder = order
+		sinks = append(sinks, sink)
+	}
+	if secrets.SMTPAddr != "" && len(secrets.MailTo) > 0 {
+		var options []MailerOption
+		if secrets.SMTPUser != "" {
+			options = append(options, WithMailAuth(secrets.SMTPUser, secrets.SMTPPassword))
+		}
+		mailer, err := NewMailer(secrets.SMTPAddr, secrets.MailFrom, secrets.MailTo, options...)
+		if err != nil {
+			return nil, errors.Wrap(err, "Fail to create mailer")
+		}
+		sink := NewMailSink(mailer)
+		sink.SectionOrder = order
+		sinks = append(sinks, sink)
+	}
+	for _, hook := range secrets.Webhooks {
+		sink := NewWebhookSink(NewWebhook(hook.URL, hook.Secret))
+		sink.SectionOrder = order
+		sinks = append(sinks, sink)
+	}
+
+	return sinks, nil
+}
@@ -0,0 +1,480 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	main "github.com/m-mizutani/GithubEmitter"
+)
+
+func TestGitHubSinkRecover(t *testing.T) {
+	ctx := context.Background()
+	report := genDummyReport()
+	marker := "ReportID: " + string(report.ID)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/search/issues", r.URL.Path)
+		q := r.URL.Query().Get("q")
+		assert.Contains(t, q, "repo:blue/five")
+
+		items := []map[string]string{}
+		if strings.Contains(q, marker) {
+			items = append(items,
+				// Loosely matched issue should be ignored.
+				map[string]string{
+					"url":      "https://api.example.com/repos/blue/five/issues/1",
+					"html_url": "https://example.com/blue/five/issues/1",
+					"body":     "Related to " + marker,
+				},
+				map[string]string{
+					"url":      "https://api.example.com/repos/blue/five/issues/2",
+					"html_url": "https://example.com/blue/five/issues/2",
+					"body":     marker + "\r\n\r\n## Overview",
+				})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"items": items})
+	}))
+	defer ts.Close()
+
+	ghe, err := main.NewGitHub(ts.URL, "blue/five", "xxx")
+	require.NoError(t, err)
+	sink := main.NewGitHubSink(ghe)
+
+	cache := main.ReportCache{ReportID: report.ID}
+	found, err := sink.Recover(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "https://api.example.com/repos/blue/five/issues/2", cache.IssueURL)
+	assert.Equal(t, "https://example.com/blue/five/issues/2", cache.HtmlURL)
+
+	report.ID = ar.NewReportID()
+	cache = main.ReportCache{ReportID: report.ID}
+	found, err = sink.Recover(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.False(t, found)
+	assert.Equal(t, "", cache.IssueURL)
+}
+
+// fakeGitHub is a minimal GitHub issue API on memory.
+type fakeGitHub struct {
+	fakeServer
+	seq      int
+	issues   map[string]map[string]interface{}
+	comments map[string][]string
+	// tokens has Authorization headers of requests by path.
+	tokens map[string][]string
+}
+
+func newFakeGitHub() *fakeGitHub {
+	x := &fakeGitHub{
+		issues:   map[string]map[string]interface{}{},
+		comments: map[string][]string{},
+		tokens:   map[string][]string{},
+	}
+	x.start(x.handle)
+	return x
+}
+
+func (x *fakeGitHub) issue(apiURL string) map[string]interface{} {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return x.issues[apiURL]
+}
+
+func (x *fakeGitHub) delete(apiURL string) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	delete(x.issues, apiURL)
+}
+
+func (x *fakeGitHub) handle(w http.ResponseWriter, r *http.Request) {
+	apiURL := x.server.URL + r.URL.Path
+	x.tokens[r.URL.Path] = append(x.tokens[r.URL.Path], r.Header.Get("Authorization"))
+	var req map[string]interface{}
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&req)
+	}
+
+	switch {
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/issues"):
+		x.seq++
+		issueURL := fmt.Sprintf("%s/%d", apiURL, x.seq)
+		issue := map[string]interface{}{
+			"url":      issueURL,
+			"html_url": strings.Replace(issueURL, "/repos/", "/html/", 1),
+			"state":    "open",
+		}
+		for k, v := range req {
+			issue[k] = v
+		}
+		issue["labels"] = toFakeLabels(req["labels"])
+		issue["assignees"] = toFakeUsers(req["assignees"])
+		x.issues[issueURL] = issue
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(issue)
+
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/comments"):
+		issueURL := strings.TrimSuffix(apiURL, "/comments")
+		if _, ok := x.issues[issueURL]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		x.comments[issueURL] = append(x.comments[issueURL], req["body"].(string))
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"url":  fmt.Sprintf("%s/%d", apiURL, len(x.comments[issueURL])),
+			"body": req["body"],
+		})
+
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/labels"):
+		issue, ok := x.issues[strings.TrimSuffix(apiURL, "/labels")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		labels := issue["labels"].([]map[string]interface{})
+		for _, label := range toFakeLabels(req["labels"]) {
+			if !hasFakeLabel(labels, label["name"]) {
+				labels = append(labels, label)
+			}
+		}
+		issue["labels"] = labels
+		json.NewEncoder(w).Encode(labels)
+
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/assignees"):
+		issue, ok := x.issues[strings.TrimSuffix(apiURL, "/assignees")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		users := issue["assignees"].([]map[string]interface{})
+		for _, user := range toFakeUsers(req["assignees"]) {
+			if !hasFakeUser(users, user["login"]) {
+				users = append(users, user)
+			}
+		}
+		issue["assignees"] = users
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(issue)
+
+	case r.Method == "DELETE" && strings.Contains(r.URL.Path, "/labels/"):
+		parts := strings.SplitN(apiURL, "/labels/", 2)
+		issue, ok := x.issues[parts[0]]
+		if !ok || !hasFakeLabel(issue["labels"].([]map[string]interface{}), parts[1]) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		labels := []map[string]interface{}{}
+		for _, label := range issue["labels"].([]map[string]interface{}) {
+			if label["name"] != parts[1] {
+				labels = append(labels, label)
+			}
+		}
+		issue["labels"] = labels
+		json.NewEncoder(w).Encode(labels)
+
+	case r.Method == "GET" || r.Method == "PATCH":
+		issue, ok := x.issues[apiURL]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"Not Found"}`))
+			return
+		}
+		for k, v := range req {
+			issue[k] = v
+		}
+		json.NewEncoder(w).Encode(issue)
+
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func toFakeLabels(v interface{}) []map[string]interface{} {
+	labels := []map[string]interface{}{}
+	names, _ := v.([]interface{})
+	for _, name := range names {
+		labels = append(labels, map[string]interface{}{"name": name})
+	}
+	return labels
+}
+
+func hasFakeLabel(labels []map[string]interface{}, name interface{}) bool {
+	for _, label := range labels {
+		if label["name"] == name {
+			return true
+		}
+	}
+	return false
+}
+
+func toFakeUsers(v interface{}) []map[string]interface{} {
+	users := []map[string]interface{}{}
+	logins, _ := v.([]interface{})
+	for _, login := range logins {
+		users = append(users, map[string]interface{}{"login": login})
+	}
+	return users
+}
+
+func hasFakeUser(users []map[string]interface{}, login interface{}) bool {
+	for _, user := range users {
+		if user["login"] == login {
+			return true
+		}
+	}
+	return false
+}
+
+func (x *fakeGitHub) assignees(apiURL string) []string {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	logins := []string{}
+	for _, user := range x.issues[apiURL]["assignees"].([]map[string]interface{}) {
+		logins = append(logins, user["login"].(string))
+	}
+	return logins
+}
+
+func (x *fakeGitHub) commentsOf(apiURL string) []string {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return append([]string{}, x.comments[apiURL]...)
+}
+
+func (x *fakeGitHub) labels(apiURL string) []string {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	names := []string{}
+	for _, label := range x.issues[apiURL]["labels"].([]map[string]interface{}) {
+		names = append(names, label["name"].(string))
+	}
+	return names
+}
+
+func TestGitHubSinkLabels(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeGitHub()
+	defer fake.Close()
+
+	ghe, err := main.NewGitHub(fake.server.URL, "blue/five", "xxx")
+	require.NoError(t, err)
+	sink := main.NewGitHubSink(ghe)
+
+	report := genDummyReport()
+	report.Result.Severity = ar.SevUnclassified
+	cache := main.ReportCache{ReportID: report.ID}
+	_, err = sink.Create(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"severity:unclassified",
+		"rule:I am a rule",
+		"attr:ipaddr",
+	}, fake.labels(cache.IssueURL))
+
+	report.Status = ar.StatusPublished
+	report.Result.Severity = ar.SevUrgent
+	_, err = sink.Comment(ctx, report, &cache)
+	require.NoError(t, err)
+	labels := fake.labels(cache.IssueURL)
+	assert.Contains(t, labels, "severity:urgent")
+	assert.NotContains(t, labels, "severity:unclassified")
+	assert.Contains(t, labels, "rule:I am a rule")
+}
+
+func TestGitHubSinkRoute(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeGitHub()
+	defer fake.Close()
+
+	ghe, err := main.NewGitHub(fake.server.URL, "blue/five", "xxx")
+	require.NoError(t, err)
+	router := main.NewRouter([]main.RouteRule{
+		{Rule: "I am a rule", Assignees: []string{"alice"}, Mentions: []string{"@org/blue"}},
+	})
+	sink := main.NewGitHubSink(ghe, main.WithRouter(router))
+
+	report := genDummyReport()
+	cache := main.ReportCache{ReportID: report.ID}
+	_, err = sink.Create(ctx, report, &cache)
+	require.NoError(t, err)
+
+	issue := fake.issue(cache.IssueURL)
+	assert.Equal(t, []string{"alice"}, fake.assignees(cache.IssueURL))
+	assert.Contains(t, issue["body"], "- CC: @org/blue\n")
+}
+
+func TestGitHubSinkRouteBySeverity(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeGitHub()
+	defer fake.Close()
+
+	ghe, err := main.NewGitHub(fake.server.URL, "blue/five", "xxx")
+	require.NoError(t, err)
+	router := main.NewRouter([]main.RouteRule{
+		{Rule: "I am a rule", Assignees: []string{"alice"}, Mentions: []string{"@org/blue"}},
+		{Severity: "urgent", Assignees: []string{"bob"}, Mentions: []string{"@org/oncall"}},
+	})
+	sink := main.NewGitHubSink(ghe, main.WithRouter(router))
+
+	// Severity is not decided yet when the issue is created.
+	report := genDummyReport()
+	report.Status = ar.StatusNew
+	cache := main.ReportCache{ReportID: report.ID}
+	_, err = sink.Create(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice"}, fake.assignees(cache.IssueURL))
+
+	report.Status = ar.StatusPublished
+	report.Result.Severity = ar.SevUrgent
+	_, err = sink.Comment(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice", "bob"}, fake.assignees(cache.IssueURL))
+	comments := fake.commentsOf(cache.IssueURL)
+	require.Equal(t, 2, len(comments))
+	assert.Equal(t, "CC: @org/oncall (severity **urgent**)", comments[0])
+	assert.NotContains(t, comments[0], "@org/blue")
+	assert.Equal(t, []string{"@org/blue", "@org/oncall"}, cache.Mentions)
+
+	// Mentions are not repeated by following reports.
+	_, err = sink.Comment(ctx, report, &cache)
+	require.NoError(t, err)
+	comments = fake.commentsOf(cache.IssueURL)
+	require.Equal(t, 3, len(comments))
+	assert.NotContains(t, comments[2], "CC:")
+	assert.Equal(t, []string{"alice", "bob"}, fake.assignees(cache.IssueURL))
+}
+
+func (x *fakeGitHub) tokensOf(path string) []string {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	return x.tokens[path]
+}
+
+func TestGitHubSinkMultiRepository(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeGitHub()
+	defer fake.Close()
+
+	ghe, err := main.NewGitHub(fake.server.URL, "blue/five", "default-token")
+	require.NoError(t, err)
+	red, err := main.NewGitHub(fake.server.URL, "red/six", "red-token")
+	require.NoError(t, err)
+	router := main.NewRouter([]main.RouteRule{
+		{AttrContext: "remote", Repository: "red/six"},
+	})
+	sink := main.NewGitHubSink(ghe, main.WithRouter(router), main.WithRepository(red))
+
+	report := genDummyReport()
+	cache := main.ReportCache{ReportID: report.ID}
+	_, err = sink.Create(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Contains(t, cache.IssueURL, "/repos/red/six/issues/")
+	assert.Equal(t, "red/six", cache.Repository)
+	assert.Equal(t, []string{"token red-token"}, fake.tokensOf("/repos/red/six/issues"))
+
+	// The report does not match the rule any more, but the cache decides
+	// the repository.
+	report.Alert.Attrs[0].Context = []string{"local"}
+	_, err = sink.Update(ctx, report, &cache)
+	require.NoError(t, err)
+	issuePath := strings.TrimPrefix(cache.IssueURL, fake.server.URL)
+	require.NotEmpty(t, fake.tokensOf(issuePath))
+	for _, token := range fake.tokensOf(issuePath) {
+		assert.Equal(t, "token red-token", token)
+	}
+
+	// Other reports go to the default repository.
+	other := genDummyReport()
+	other.Alert.Attrs[0].Context = nil
+	otherCache := main.ReportCache{ReportID: other.ID}
+	_, err = sink.Create(ctx, other, &otherCache)
+	require.NoError(t, err)
+	assert.Contains(t, otherCache.IssueURL, "/repos/blue/five/issues/")
+	assert.Equal(t, "", otherCache.Repository)
+
+	// Unknown repository in the cache is an error.
+	otherCache.Repository = "green/seven"
+	_, err = sink.Update(ctx, other, &otherCache)
+	assert.Error(t, err)
+}
+
+func TestGitHubSinkReopen(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeGitHub()
+	defer fake.Close()
+
+	ghe, err := main.NewGitHub(fake.server.URL, "blue/five", "xxx")
+	require.NoError(t, err)
+	sink := main.NewGitHubSink(ghe)
+
+	report := genDummyReport()
+	cache := main.ReportCache{ReportID: report.ID}
+	_, err = sink.Create(ctx, report, &cache)
+	require.NoError(t, err)
+
+	report.Status = ar.StatusPublished
+	report.Result.Severity = ar.SevSafe
+	_, err = sink.Comment(ctx, report, &cache)
+	require.NoError(t, err)
+	_, err = sink.Resolve(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Equal(t, "closed", fake.issue(cache.IssueURL)["state"])
+
+	report.Result.Severity = ar.SevUrgent
+	_, err = sink.Comment(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Equal(t, "open", fake.issue(cache.IssueURL)["state"])
+
+	fake.mutex.Lock()
+	comments := fake.comments[cache.IssueURL]
+	fake.mutex.Unlock()
+	require.Equal(t, 3, len(comments))
+	assert.Contains(t, comments[1], "Reopened")
+	assert.Contains(t, comments[2], "Severity: urgent")
+}
+
+func TestGitHubSinkDeletedIssue(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeGitHub()
+	defer fake.Close()
+
+	ghe, err := main.NewGitHub(fake.server.URL, "blue/five", "xxx")
+	require.NoError(t, err)
+	sink := main.NewGitHubSink(ghe)
+
+	report := genDummyReport()
+	cache := main.ReportCache{ReportID: report.ID}
+	_, err = sink.Create(ctx, report, &cache)
+	require.NoError(t, err)
+	oldURL := cache.IssueURL
+	require.NotNil(t, fake.issue(oldURL))
+
+	// The issue is deleted by someone.
+	fake.delete(oldURL)
+
+	report.Status = ar.StatusPublished
+	report.Result.Severity = ar.SevUrgent
+	res, err := sink.Comment(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.NotEqual(t, oldURL, cache.IssueURL)
+	assert.Contains(t, res.ApiURL, cache.IssueURL)
+	assert.NotNil(t, fake.issue(cache.IssueURL))
+
+	// Resolve should not fail for a deleted issue.
+	fake.delete(cache.IssueURL)
+	res, err = sink.Resolve(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultSlackEndpoint = "https://slack.com/api"
+	defaultSlackTimeout  = 30 * time.Second
+)
+
+// SlackAPIError is an error response of Slack Web API. Slack returns HTTP
+// 200 with "ok": false for most errors, e.g. "channel_not_found".
+type SlackAPIError struct {
+	StatusCode int
+	Code       string
+}
+
+func (x *SlackAPIError) Error() string {
+	return fmt.Sprintf("Slack API error (%d): %s", x.StatusCode, x.Code)
+}
+
+// SlackMessage is a message posted by chat.postMessage. ThreadTS makes it
+// a reply in the thread.
+type SlackMessage struct {
+	Channel  string `json:"channel"`
+	Text     string `json:"text"`
+	ThreadTS string `json:"thread_ts,omitempty"`
+}
+
+// Slack is a client of Slack Web API with a bot token.
+type Slack struct {
+	endpoint string
+	token    string
+	client   *http.Client
+}
+
+// SlackOption is an optional setting of Slack client.
+type SlackOption func(x *Slack)
+
+// WithSlackEndpoint replaces base URL of Slack Web API, e.g. for a local stub.
+func WithSlackEndpoint(endpoint string) SlackOption {
+	return func(x *Slack) {
+		x.endpoint = endpoint
+	}
+}
+
+// NewSlack returns a Slack client with the bot token.
+func NewSlack(token string, options ...SlackOption) *Slack {
+	x := &Slack{
+		endpoint: defaultSlackEndpoint,
+		token:    token,
+		client:   &http.Client{Timeout: defaultSlackTimeout},
+	}
+	for _, opt := range options {
+		opt(x)
+	}
+	return x
+}
+
+func (x *Slack) call(ctx context.Context, method string, data interface{}, result interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrapf(err, "Fail to marshal Slack %s request", method)
+	}
+
+	apiURL := fmt.Sprintf("%s/%s", strings.TrimRight(x.endpoint, "/"), method)
+	req, err := http.NewRequest("POST", apiURL, bytes.NewReader(raw))
+	if err != nil {
+		return errors.Wrapf(err, "Fail to create Slack %s request", method)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+x.token)
+
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "Fail to send Slack %s request", method)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrapf(err, "Fail to read Slack %s response", method)
+	}
+
+	var status struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		json.Unmarshal(body, &status)
+		if status.Error == "" {
+			status.Error = http.StatusText(resp.StatusCode)
+		}
+		return &SlackAPIError{StatusCode: resp.StatusCode, Code: status.Error}
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return errors.Wrapf(err, "Fail to parse Slack %s response", method)
+	}
+	if !status.OK {
+		return &SlackAPIError{StatusCode: resp.StatusCode, Code: status.Error}
+	}
+
+	if result != nil {
+		if err := json.Unmarshal(body, result); err != nil {
+			return errors.Wrapf(err, "Fail to parse Slack %s response", method)
+		}
+	}
+	return nil
+}
+
+// PostMessage posts the message and returns channel ID and ts of it. The
+// ts is an ID of the message in the channel.
+func (x *Slack) PostMessage(ctx context.Context, msg SlackMessage) (channel, ts string, err error) {
+	var result struct {
+		Channel string `json:"channel"`
+		TS      string `json:"ts"`
+	}
+	if err := x.call(ctx, "chat.postMessage", msg, &result); err != nil {
+		return "", "", err
+	}
+	return result.Channel, result.TS, nil
+}
+
+// UpdateMessage replaces text of the message.
+func (x *Slack) UpdateMessage(ctx context.Context, channel, ts, text string) error {
+	req := struct {
+		Channel string `json:"channel"`
+		TS      string `json:"ts"`
+		Text    string `json:"text"`
+	}{
+		Channel: channel,
+		TS:      ts,
+		Text:    text,
+	}
+	return x.call(ctx, "chat.update", req, nil)
+}
+
+const slackSinkName = "slack"
+
+// SlackSink posts a report to a Slack channel. The first message is the root
+// of a thread for the report, and later updates and the published report are
+// posted as replies. The root message is edited to show current severity.
+type SlackSink struct {
+	slack   *Slack
+	channel string
+}
+
+// NewSlackSink returns a sink for the Slack channel.
+func NewSlackSink(slack *Slack, channel string) *SlackSink {
+	return &SlackSink{slack: slack, channel: channel}
+}
+
+func (x *SlackSink) Name() string { return slackSinkName }
+
+// slackLink returns a link in mrkdwn, or an empty string if the URL is not
+// safe to link.
+func slackLink(link, text string) string {
+	u, ok := safeLinkURL(link)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("<%s|%s>", u, EscapeSlack(text))
+}
+
+// buildSlackRoot creates text of the root message of the report.
+func buildSlackRoot(report ar.Report, cache *ReportCache, state string) string {
+	severity := string(report.Result.Severity)
+	if severity == "" {
+		severity = "N/A"
+	}
+
+	lines := []string{
+		fmt.Sprintf("*%s*", EscapeSlack(report.Alert.Title())),
+		fmt.Sprintf("Severity: *%s*", EscapeSlack(severity)),
+		fmt.Sprintf("Status: %s", state),
+	}
+	if link := slackLink(cache.issueLink(), "issue"); link != "" {
+		lines = append(lines, fmt.Sprintf("Issue: %s", link))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// buildSlackAlert creates a summary of the alert of the report in mrkdwn.
+// GitHub Markdown of the issue body is not rendered by Slack.
+func buildSlackAlert(report ar.Report) string {
+	lines := []string{
+		fmt.Sprintf("Detected by %s", EscapeSlack(report.Alert.Rule)),
+	}
+	for _, attr := range report.Alert.Attrs {
+		if attr.Type == "json" {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("• %s: %s", EscapeSlack(attr.Key), EscapeSlack(attr.Value)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// buildSlackPublished creates a summary of the published report in mrkdwn.
+// Details are linked to the comment in the issue.
+func buildSlackPublished(report ar.Report, cache *ReportCache) string {
+	reason := report.Result.Reason
+	if reason == "" {
+		reason = "N/A"
+	}
+
+	lines := []string{
+		fmt.Sprintf("Report is published: *%s*", EscapeSlack(report.Alert.Title())),
+		fmt.Sprintf("Severity: *%s*", EscapeSlack(string(report.Result.Severity))),
+		fmt.Sprintf("Reason: %s", EscapeSlack(reason)),
+	}
+	if link := slackLink(cache.commentLink(), "report"); link != "" {
+		lines = append(lines, fmt.Sprintf("Details: %s", link))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (x *SlackSink) Create(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	text := buildSlackRoot(report, cache, "open") + "\n\n" + buildSlackAlert(report)
+	channel, ts, err := x.slack.PostMessage(ctx, SlackMessage{Channel: x.channel, Text: text})
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to post a report to Slack")
+	}
+	cache.SlackChannel = channel
+	cache.SlackThreadTS = ts
+
+	return &SinkResult{Sink: x.Name(), Action: sinkCreate}, nil
+}
+
+// reply posts the text in the thread of the report. If the report has no
+// thread yet (e.g. Slack is configured later), it posts a root message.
+func (x *SlackSink) reply(ctx context.Context, report ar.Report, cache *ReportCache, text string) error {
+	if cache.SlackThreadTS == "" {
+		if _, err := x.Create(ctx, report, cache); err != nil {
+			return err
+		}
+	}
+
+	msg := SlackMessage{Channel: cache.SlackChannel, Text: text, ThreadTS: cache.SlackThreadTS}
+	if _, _, err := x.slack.PostMessage(ctx, msg); err != nil {
+		return errors.Wrap(err, "Fail to reply to Slack thread")
+	}
+	return nil
+}
+
+func (x *SlackSink) updateRoot(ctx context.Context, report ar.Report, cache *ReportCache, state string) error {
+	text := buildSlackRoot(report, cache, state) + "\n\n" + buildSlackAlert(report)
+	if err := x.slack.UpdateMessage(ctx, cache.SlackChannel, cache.SlackThreadTS, text); err != nil {
+		return errors.Wrap(err, "Fail to update root message in Slack")
+	}
+	return nil
+}
+
+func (x *SlackSink) Update(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	if err := x.reply(ctx, report, cache, buildSlackAlert(report)); err != nil {
+		return nil, err
+	}
+	return &SinkResult{Sink: x.Name(), Action: sinkUpdate}, nil
+}
+
+func (x *SlackSink) Comment(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	if err := x.reply(ctx, report, cache, buildSlackPublished(report, cache)); err != nil {
+		return nil, err
+	}
+	if err := x.updateRoot(ctx, report, cache, "published"); err != nil {
+		return nil, err
+	}
+	return &SinkResult{Sink: x.Name(), Action: sinkComment}, nil
+}
+
+func (x *SlackSink) Resolve(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	if cache.SlackThreadTS == "" {
+		return nil, nil
+	}
+	if err := x.updateRoot(ctx, report, cache, "resolved"); err != nil {
+		return nil, err
+	}
+	return &SinkResult{Sink: x.Name(), Action: sinkResolve}, nil
+}
@@ -0,0 +1,146 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	main "github.com/m-mizutani/GithubEmitter"
+)
+
+type slackCall struct {
+	method string
+	req    map[string]interface{}
+}
+
+// fakeSlack is a stub of Slack Web API that records calls.
+type fakeSlack struct {
+	fakeServer
+	calls []slackCall
+}
+
+func newFakeSlack() *fakeSlack {
+	x := &fakeSlack{}
+	x.start(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		x.calls = append(x.calls, slackCall{method: strings.TrimPrefix(r.URL.Path, "/"), req: req})
+
+		if r.Header.Get("Authorization") != "Bearer xoxb-test" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error": "invalid_auth"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ok":      true,
+			"channel": "C0001",
+			"ts":      fmt.Sprintf("1500000000.%06d", len(x.calls)),
+		})
+	})
+	return x
+}
+
+func TestSlackSink(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeSlack()
+	defer fake.Close()
+
+	slack := main.NewSlack("xoxb-test", main.WithSlackEndpoint(fake.server.URL))
+	sink := main.NewSlackSink(slack, "#security")
+
+	report := genDummyReport()
+	cache := main.ReportCache{ReportID: report.ID, HtmlURL: "https://example.com/issues/1"}
+	_, err := sink.Create(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Equal(t, "C0001", cache.SlackChannel)
+	assert.Equal(t, "1500000000.000001", cache.SlackThreadTS)
+
+	_, err = sink.Update(ctx, report, &cache)
+	require.NoError(t, err)
+
+	report.Status = ar.StatusPublished
+	report.Result.Severity = ar.SevUrgent
+	_, err = sink.Comment(ctx, report, &cache)
+	require.NoError(t, err)
+
+	require.Equal(t, 4, len(fake.calls))
+	root := fake.calls[0]
+	assert.Equal(t, "chat.postMessage", root.method)
+	assert.Equal(t, "#security", root.req["channel"])
+	assert.Nil(t, root.req["thread_ts"])
+	assert.Contains(t, root.req["text"], "Issue: <https://example.com/issues/1|issue>")
+	assert.Contains(t, root.req["text"], "• source address: 10.0.0.1")
+	assert.NotContains(t, root.req["text"], "## Overview")
+
+	for _, call := range fake.calls[1:3] {
+		assert.Equal(t, "chat.postMessage", call.method)
+		assert.Equal(t, "C0001", call.req["channel"])
+		assert.Equal(t, cache.SlackThreadTS, call.req["thread_ts"])
+	}
+
+	published := fake.calls[2].req["text"].(string)
+	assert.Contains(t, published, "Severity: *urgent*")
+	assert.Contains(t, published, "Details: <https://example.com/issues/1|report>")
+	assert.NotContains(t, published, "# Report")
+
+	edit := fake.calls[3]
+	assert.Equal(t, "chat.update", edit.method)
+	assert.Equal(t, cache.SlackThreadTS, edit.req["ts"])
+	assert.Contains(t, edit.req["text"], "Severity: *urgent*")
+}
+
+func TestSlackEscape(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeSlack()
+	defer fake.Close()
+
+	slack := main.NewSlack("xoxb-test", main.WithSlackEndpoint(fake.server.URL))
+	sink := main.NewSlackSink(slack, "#security")
+
+	hostile := "<!channel> <@U0001> <https://evil.example.com|click> & more"
+	report := genDummyReport()
+	report.Alert.Name = hostile
+	report.Alert.Rule = hostile
+	report.Alert.Attrs[0].Key = hostile
+	report.Alert.Attrs[0].Value = hostile
+	report.Result.Reason = hostile
+	cache := main.ReportCache{ReportID: report.ID, HtmlURL: "javascript:alert(1)"}
+	_, err := sink.Create(ctx, report, &cache)
+	require.NoError(t, err)
+
+	report.Status = ar.StatusPublished
+	report.Result.Severity = ar.SevUrgent
+	_, err = sink.Comment(ctx, report, &cache)
+	require.NoError(t, err)
+
+	escaped := "&lt;!channel&gt; &lt;@U0001&gt; &lt;https://evil.example.com|click&gt; &amp; more"
+	require.Equal(t, 3, len(fake.calls))
+	for _, call := range fake.calls {
+		text := call.req["text"].(string)
+		// Only brackets of links made by the sink are left.
+		assert.NotContains(t, text, "<!")
+		assert.NotContains(t, text, "<@")
+		assert.NotContains(t, text, "<https://evil")
+		assert.NotContains(t, text, "javascript:")
+		assert.Contains(t, text, escaped)
+	}
+	assert.Contains(t, fake.calls[1].req["text"], "Reason: "+escaped)
+}
+
+func TestSlackAPIError(t *testing.T) {
+	fake := newFakeSlack()
+	defer fake.Close()
+
+	slack := main.NewSlack("bad-token", main.WithSlackEndpoint(fake.server.URL))
+	_, _, err := slack.PostMessage(context.Background(), main.SlackMessage{Channel: "#security", Text: "hello"})
+	require.Error(t, err)
+	apiErr, ok := err.(*main.SlackAPIError)
+	require.True(t, ok)
+	assert.Equal(t, "invalid_auth", apiErr.Code)
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/guregu/dynamo"
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+)
+
+// ReportCache is a record of ReportStore. It keeps states of sinks (e.g. URL
+// of GitHub issue) for a report.
+type ReportCache struct {
+	ReportID ar.ReportID `dynamo:"report_id" json:"report_id"`
+	IssueURL string      `dynamo:"issue_url" json:"issue_url"`
+	HtmlURL  string      `dynamo:"html_url" json:"html_url"`
+	State    string      `dynamo:"state" json:"state"`
+
+	// Repository and Endpoint are GitHub repository that owns the issue.
+	// Empty means the default repository.
+	Repository string `dynamo:"repository" json:"repository,omitempty"`
+	Endpoint   string `dynamo:"endpoint" json:"endpoint,omitempty"`
+
+	// Mentions are users and teams that have been CC'd in the GitHub issue.
+	Mentions []string `dynamo:"mentions" json:"mentions,omitempty"`
+
+	// PagerDutyState is the last event sent to PagerDuty for the report,
+	// e.g. "trigger". Empty means that no incident exists.
+	PagerDutyState string `dynamo:"pagerduty_state" json:"pagerduty_state,omitempty"`
+	// PagerDutySeverity is severity of the report when the last event was
+	// sent. A downgrade is detected by comparing it with current severity.
+	PagerDutySeverity string `dynamo:"pagerduty_severity" json:"pagerduty_severity,omitempty"`
+
+	// SlackChannel and SlackThreadTS identify the root message of the
+	// report in Slack. Updates are posted as replies in the thread.
+	SlackChannel  string `dynamo:"slack_channel" json:"slack_channel,omitempty"`
+	SlackThreadTS string `dynamo:"slack_thread_ts" json:"slack_thread_ts,omitempty"`
+
+	// JiraKey and JiraURL are key (e.g. "SEC-123") and browser URL of the
+	// Jira issue.
+	JiraKey string `dynamo:"jira_key" json:"jira_key,omitempty"`
+	JiraURL string `dynamo:"jira_url" json:"jira_url,omitempty"`
+
+	// GitLabProjectID and GitLabIID address the GitLab issue, and GitLabURL
+	// is URL of it for browser.
+	GitLabProjectID int64  `dynamo:"gitlab_project_id" json:"gitlab_project_id,omitempty"`
+	GitLabIID       int64  `dynamo:"gitlab_iid" json:"gitlab_iid,omitempty"`
+	GitLabURL       string `dynamo:"gitlab_url" json:"gitlab_url,omitempty"`
+
+	// TeamsActivityID is ID of the message that has the card of the report
+	// in Teams.
+	TeamsActivityID string `dynamo:"teams_activity_id" json:"teams_activity_id,omitempty"`
+
+	// CommentHtmlURL is URL of the comment of the last published report in
+	// the GitHub issue.
+	CommentHtmlURL string `dynamo:"comment_html_url" json:"comment_html_url,omitempty"`
+
+	// Event is digest of a report that failed to be emitted to some sinks,
+	// and Done has actions of sinks that succeeded for it, e.g.
+	// "slack:comment". The same report delivered again skips the actions.
+	Event string   `dynamo:"event" json:"event,omitempty"`
+	Done  []string `dynamo:"done" json:"done,omitempty"`
+
+	// TTL is expiration time of the record as UNIX epoch seconds. DynamoDB
+	// deletes the record after the time. Zero means no expiration.
+	TTL int64 `dynamo:"ttl" json:"ttl"`
+	// ClaimExpires is end of the lease of a pending record as UNIX epoch
+	// seconds. Another writer can take over the claim after it, e.g. when
+	// the writer crashed.
+	ClaimExpires int64 `dynamo:"claim_expires" json:"claim_expires,omitempty"`
+}
+
+const (
+	// cacheStatePending means that a writer claimed the record and is
+	// creating the issue.
+	cacheStatePending = "pending"
+	cacheStateReady   = "ready"
+)
+
+func (x ReportCache) isPending() bool {
+	return x.State == cacheStatePending
+}
+
+// claimExpired returns true if the record is pending and the lease of the
+// claim has passed. A pending record without lease is also expired.
+func (x ReportCache) claimExpired(now time.Time) bool {
+	return x.isPending() && x.ClaimExpires < now.Unix()
+}
+
+// claimable returns true if a writer can claim the record.
+func (x ReportCache) claimable(now time.Time) bool {
+	return x.Expired(now) || x.claimExpired(now)
+}
+
+// Issue trackers that own the issue of a report.
+const (
+	trackerGitHub = "github"
+	trackerGitLab = "gitlab"
+	trackerJira   = "jira"
+)
+
+// issue returns the issue tracker and URLs of the issue for API and browser.
+// GitHub issue is preferred to GitLab and Jira issues. Both URLs are of the
+// same issue, and URL for API is empty except GitHub because it's not kept.
+func (x ReportCache) issue() (tracker, apiURL, htmlURL string) {
+	switch {
+	case x.HtmlURL != "":
+		return trackerGitHub, x.IssueURL, x.HtmlURL
+	case x.GitLabURL != "":
+		return trackerGitLab, "", x.GitLabURL
+	case x.JiraURL != "":
+		return trackerJira, "", x.JiraURL
+	default:
+		return "", "", ""
+	}
+}
+
+// issueLink returns URL of the issue for browser.
+func (x ReportCache) issueLink() string {
+	_, _, link := x.issue()
+	return link
+}
+
+// commentLink returns URL of the last published report in GitHub, or URL of
+// the issue if it's not available.
+func (x ReportCache) commentLink() string {
+	if x.CommentHtmlURL != "" {
+		return x.CommentHtmlURL
+	}
+	return x.issueLink()
+}
+
+// startProgress starts to record progress of sinks for a report. Progress
+// of another report is dropped except creation, which is once for a report.
+func (x *ReportCache) startProgress(event string) {
+	if x.Event == event {
+		return
+	}
+
+	var done []string
+	for _, d := range x.Done {
+		if strings.HasSuffix(d, ":"+sinkCreate) {
+			done = append(done, d)
+		}
+	}
+	x.Event, x.Done = event, done
+}
+
+func (x *ReportCache) clearProgress() {
+	x.Event, x.Done = "", nil
+}
+
+func (x ReportCache) isDone(sink, action string) bool {
+	for _, d := range x.Done {
+		if d == sink+":"+action {
+			return true
+		}
+	}
+	return false
+}
+
+func (x *ReportCache) setDone(sink, action string) {
+	if !x.isDone(sink, action) {
+		x.Done = append(x.Done, sink+":"+action)
+	}
+}
+
+// Expired returns true if TTL of the record has passed. DynamoDB deletes
+// expired items lazily, then Get may still return them.
+func (x ReportCache) Expired(now time.Time) bool {
+	return x.TTL != 0 && x.TTL < now.Unix()
+}
+
+// ErrReportNotFound is returned by ReportStore.Get if no record exists.
+var ErrReportNotFound = errors.New("Report is not found in store")
+
+// ReportStore saves ReportCache records by ReportID.
+type ReportStore interface {
+	Get(ctx context.Context, reportID ar.ReportID) (*ReportCache, error)
+	Put(ctx context.Context, cache ReportCache) error
+
+	// Claim puts a pending record only if no record of the report exists,
+	// the existing record is expired or the lease of the existing claim has
+	// passed. It returns false if another writer already has the record.
+	Claim(ctx context.Context, cache ReportCache) (bool, error)
+}
+
+// DynamoStore is ReportStore backed by a DynamoDB table. The table must have
+// report_id (string) as hash key.
+type DynamoStore struct {
+	table dynamo.Table
+}
+
+// NewDynamoStore returns a store for the DynamoDB table.
+func NewDynamoStore(region, tableName string) *DynamoStore {
+	db := dynamo.New(session.New(), &aws.Config{Region: aws.String(region)})
+	return &DynamoStore{table: db.Table(tableName)}
+}
+
+func (x *DynamoStore) Get(ctx context.Context, reportID ar.ReportID) (*ReportCache, error) {
+	var cache ReportCache
+	err := x.table.Get("report_id", reportID).OneWithContext(ctx, &cache)
+
+	switch err {
+	case nil:
+		return &cache, nil
+	case dynamo.ErrNotFound:
+		return nil, ErrReportNotFound
+	default:
+		return nil, errors.Wrap(err, "Fail to get cache from DynamoDB")
+	}
+}
+
+func (x *DynamoStore) Put(ctx context.Context, cache ReportCache) error {
+	if err := x.table.Put(cache).RunWithContext(ctx); err != nil {
+		return errors.Wrap(err, "Fail to put cache to DynamoDB")
+	}
+	return nil
+}
+
+func (x *DynamoStore) Claim(ctx context.Context, cache ReportCache) (bool, error) {
+	now := time.Now().Unix()
+	cache.State = cacheStatePending
+	err := x.table.Put(cache).
+		If("attribute_not_exists($) OR ($ > ? AND $ < ?) OR ($ = ? AND NOT $ >= ?)",
+			"report_id", "ttl", 0, "ttl", now, "state", cacheStatePending, "claim_expires", now).
+		RunWithContext(ctx)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok &&
+			aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "Fail to claim cache in DynamoDB")
+	}
+	return true, nil
+}
+
+// MemoryStore is ReportStore on memory for unit tests and local runs.
+type MemoryStore struct {
+	mutex   sync.Mutex
+	records map[ar.ReportID]ReportCache
+}
+
+// NewMemoryStore returns an empty store on memory.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: map[ar.ReportID]ReportCache{}}
+}
+
+func (x *MemoryStore) Get(ctx context.Context, reportID ar.ReportID) (*ReportCache, error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	cache, ok := x.records[reportID]
+	if !ok {
+		return nil, ErrReportNotFound
+	}
+	return &cache, nil
+}
+
+func (x *MemoryStore) Put(ctx context.Context, cache ReportCache) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	x.records[cache.ReportID] = cache
+	return nil
+}
+
+func (x *MemoryStore) Claim(ctx context.Context, cache ReportCache) (bool, error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if old, ok := x.records[cache.ReportID]; ok && !old.claimable(time.Now()) {
+		return false, nil
+	}
+	cache.State = cacheStatePending
+	x.records[cache.ReportID] = cache
+	return true, nil
+}
+
+// FileStore is ReportStore saved as a JSON file for local runs. All records
+// are loaded and saved on every access, then it's not for large data.
+type FileStore struct {
+	mutex sync.Mutex
+	path  string
+}
+
+// NewFileStore returns a store saved in the path. The file is created by
+// the first Put if it does not exist.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+func (x *FileStore) load() (map[ar.ReportID]ReportCache, error) {
+	records := map[ar.ReportID]ReportCache{}
+
+	raw, err := ioutil.ReadFile(x.path)
+	if os.IsNotExist(err) {
+		return records, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Fail to read store file: %s", x.path)
+	}
+
+	if err := json.Unmarshal(raw, &records); err != nil {
+		return nil, errors.Wrapf(err, "Fail to parse store file: %s", x.path)
+	}
+	return records, nil
+}
+
+func (x *FileStore) save(records map[ar.ReportID]ReportCache) error {
+	raw, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Fail to marshal store records")
+	}
+
+	// Write a temp file and rename it to avoid broken file by crash.
+	tmp, err := ioutil.TempFile(filepath.Dir(x.path), filepath.Base(x.path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "Fail to create temp file of store")
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "Fail to write store records")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "Fail to close temp file of store")
+	}
+
+	if err := os.Rename(tmp.Name(), x.path); err != nil {
+		return errors.Wrapf(err, "Fail to save store file: %s", x.path)
+	}
+	return nil
+}
+
+func (x *FileStore) Get(ctx context.Context, reportID ar.ReportID) (*ReportCache, error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	records, err := x.load()
+	if err != nil {
+		return nil, err
+	}
+
+	cache, ok := records[reportID]
+	if !ok {
+		return nil, ErrReportNotFound
+	}
+	return &cache, nil
+}
+
+func (x *FileStore) Put(ctx context.Context, cache ReportCache) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	records, err := x.load()
+	if err != nil {
+		return err
+	}
+
+	records[cache.ReportID] = cache
+	return x.save(records)
+}
+
+func (x *FileStore) Claim(ctx context.Context, cache ReportCache) (bool, error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	records, err := x.load()
+	if err != nil {
+		return false, err
+	}
+
+	if old, ok := records[cache.ReportID]; ok && !old.claimable(time.Now()) {
+		return false, nil
+	}
+	cache.State = cacheStatePending
+	records[cache.ReportID] = cache
+	return true, x.save(records)
+}
@@ -0,0 +1,118 @@
+package main_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	main "github.com/m-mizutani/GithubEmitter"
+)
+
+func testReportStore(t *testing.T, store main.ReportStore) {
+	ctx := context.Background()
+	id1 := ar.NewReportID()
+	id2 := ar.NewReportID()
+
+	cache, err := store.Get(ctx, id1)
+	assert.Equal(t, main.ErrReportNotFound, err)
+	assert.Nil(t, cache)
+
+	require.NoError(t, store.Put(ctx, main.ReportCache{ReportID: id1, IssueURL: "https://a"}))
+	require.NoError(t, store.Put(ctx, main.ReportCache{ReportID: id2, IssueURL: "https://b"}))
+
+	cache, err = store.Get(ctx, id1)
+	require.NoError(t, err)
+	assert.Equal(t, "https://a", cache.IssueURL)
+
+	// Overwrite
+	require.NoError(t, store.Put(ctx, main.ReportCache{ReportID: id1, IssueURL: "https://c"}))
+	cache, err = store.Get(ctx, id1)
+	require.NoError(t, err)
+	assert.Equal(t, "https://c", cache.IssueURL)
+
+	cache, err = store.Get(ctx, id2)
+	require.NoError(t, err)
+	assert.Equal(t, "https://b", cache.IssueURL)
+
+	// Claim only succeeds if no record exists.
+	id3 := ar.NewReportID()
+	lease := time.Now().Add(time.Minute).Unix()
+	claimed, err := store.Claim(ctx, main.ReportCache{ReportID: id3, ClaimExpires: lease})
+	require.NoError(t, err)
+	assert.True(t, claimed)
+
+	claimed, err = store.Claim(ctx, main.ReportCache{ReportID: id3, ClaimExpires: lease})
+	require.NoError(t, err)
+	assert.False(t, claimed)
+
+	claimed, err = store.Claim(ctx, main.ReportCache{ReportID: id1, ClaimExpires: lease})
+	require.NoError(t, err)
+	assert.False(t, claimed)
+
+	// Release the claim by a pending record without lease.
+	require.NoError(t, store.Put(ctx, main.ReportCache{ReportID: id3, State: "pending"}))
+	claimed, err = store.Claim(ctx, main.ReportCache{ReportID: id3, ClaimExpires: lease})
+	require.NoError(t, err)
+	assert.True(t, claimed)
+
+	// Claim takes over a pending record after the lease.
+	id5 := ar.NewReportID()
+	past := time.Now().Add(-time.Hour).Unix()
+	claimed, err = store.Claim(ctx, main.ReportCache{ReportID: id5, ClaimExpires: past})
+	require.NoError(t, err)
+	assert.True(t, claimed)
+	claimed, err = store.Claim(ctx, main.ReportCache{ReportID: id5, IssueURL: "https://f", ClaimExpires: lease})
+	require.NoError(t, err)
+	assert.True(t, claimed)
+	cache, err = store.Get(ctx, id5)
+	require.NoError(t, err)
+	assert.Equal(t, "https://f", cache.IssueURL)
+	assert.Equal(t, "pending", cache.State)
+
+	// A ready record never expires without TTL.
+	claimed, err = store.Claim(ctx, main.ReportCache{ReportID: id2, ClaimExpires: lease})
+	require.NoError(t, err)
+	assert.False(t, claimed)
+
+	// Claim overwrites an expired record.
+	id4 := ar.NewReportID()
+	require.NoError(t, store.Put(ctx, main.ReportCache{ReportID: id4, IssueURL: "https://e", TTL: past}))
+	cache, err = store.Get(ctx, id4)
+	require.NoError(t, err)
+	assert.True(t, cache.Expired(time.Now()))
+
+	claimed, err = store.Claim(ctx, main.ReportCache{ReportID: id4, ClaimExpires: lease})
+	require.NoError(t, err)
+	assert.True(t, claimed)
+	cache, err = store.Get(ctx, id4)
+	require.NoError(t, err)
+	assert.Equal(t, "", cache.IssueURL)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testReportStore(t, main.NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cache.json")
+	testReportStore(t, main.NewFileStore(path))
+
+	// Records should be available from another instance.
+	id := ar.NewReportID()
+	require.NoError(t, main.NewFileStore(path).Put(ctx, main.ReportCache{ReportID: id, IssueURL: "https://d"}))
+	cache, err := main.NewFileStore(path).Get(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "https://d", cache.IssueURL)
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTeamsTokenURL = "https://login.microsoftonline.com/botframework.com/oauth2/v2.0/token"
+	teamsTokenScope      = "https://api.botframework.com/.default"
+	defaultTeamsTimeout  = 30 * time.Second
+
+	adaptiveCardContentType = "application/vnd.microsoft.card.adaptive"
+
+	// A token is renewed a little before expiration to avoid rejection by
+	// clock skew.
+	teamsTokenMargin = time.Minute
+)
+
+// TeamsAPIError is an error response of Bot Framework Connector API or the
+// token endpoint.
+type TeamsAPIError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (x *TeamsAPIError) Error() string {
+	return fmt.Sprintf("Teams API error (%d): %s %s", x.StatusCode, x.Code, x.Message)
+}
+
+// IsTeamsNotFound returns true if the error means that the activity (message)
+// does not exist.
+func IsTeamsNotFound(err error) bool {
+	apiErr, ok := errors.Cause(err).(*TeamsAPIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+func newTeamsAPIError(statusCode int, body []byte) *TeamsAPIError {
+	apiErr := &TeamsAPIError{StatusCode: statusCode}
+
+	var resp struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &resp); err == nil && resp.Error.Code != "" {
+		apiErr.Code = resp.Error.Code
+		apiErr.Message = resp.Error.Message
+		return apiErr
+	}
+
+	// The token endpoint returns an OAuth2 error.
+	var oauthResp struct {
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.Unmarshal(body, &oauthResp); err == nil && oauthResp.Error != "" {
+		apiErr.Code = oauthResp.Error
+		apiErr.Message = oauthResp.Description
+		return apiErr
+	}
+
+	apiErr.Message = strings.TrimSpace(string(body))
+	return apiErr
+}
+
+// Teams is a client of Bot Framework Connector API to post Adaptive Cards
+// to a conversation (channel or chat) of Microsoft Teams as a bot.
+type Teams struct {
+	appID          string
+	appPassword    string
+	serviceURL     string
+	conversationID string
+	tokenURL       string
+	client         *http.Client
+
+	mutex   sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// TeamsOption is an optional setting of Teams client.
+type TeamsOption func(x *Teams)
+
+// WithTeamsTokenURL replaces URL of the token endpoint, e.g. for a single
+// tenant bot or a local stub.
+func WithTeamsTokenURL(tokenURL string) TeamsOption {
+	return func(x *Teams) {
+		x.tokenURL = tokenURL
+	}
+}
+
+// NewTeams returns a Teams client. serviceURL is base URL of the connector
+// that is given by Teams to the bot, e.g. https://smba.trafficmanager.net/apac/
+func NewTeams(appID, appPassword, serviceURL, conversationID string, options ...TeamsOption) *Teams {
+	x := &Teams{
+		appID:          appID,
+		appPassword:    appPassword,
+		serviceURL:     strings.TrimRight(serviceURL, "/"),
+		conversationID: conversationID,
+		tokenURL:       defaultTeamsTokenURL,
+		client:         &http.Client{Timeout: defaultTeamsTimeout},
+	}
+	for _, opt := range options {
+		opt(x)
+	}
+	return x
+}
+
+// accessToken returns a token of the bot by client credentials grant. The
+// token is cached until expiration.
+func (x *Teams) accessToken(ctx context.Context) (string, error) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+
+	if x.token != "" && time.Now().Before(x.expires) {
+		return x.token, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", x.appID)
+	form.Set("client_secret", x.appPassword)
+	form.Set("scope", teamsTokenScope)
+
+	req, err := http.NewRequest("POST", x.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errors.Wrap(err, "Fail to create Teams token request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "Fail to send Teams token request")
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "Fail to read Teams token response")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", newTeamsAPIError(resp.StatusCode, raw)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(raw, &token); err != nil {
+		return "", errors.Wrap(err, "Fail to parse Teams token response")
+	}
+
+	x.token = token.AccessToken
+	x.expires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - teamsTokenMargin)
+	return x.token, nil
+}
+
+func (x *Teams) request(ctx context.Context, method, path string, data, result interface{}) error {
+	token, err := x.accessToken(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Fail to get Teams access token")
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "Fail to marshal Teams request")
+	}
+
+	req, err := http.NewRequest(method, x.serviceURL+path, bytes.NewReader(raw))
+	if err != nil {
+		return errors.Wrap(err, "Fail to create Teams request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "Fail to send Teams request")
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "Fail to read Teams response")
+	}
+	if resp.StatusCode < 200 || 300 <= resp.StatusCode {
+		return newTeamsAPIError(resp.StatusCode, body)
+	}
+
+	if result != nil && len(body) > 0 {
+		if err := json.Unmarshal(body, result); err != nil {
+			return errors.Wrap(err, "Fail to parse Teams response")
+		}
+	}
+	return nil
+}
+
+func (x *Teams) activitiesPath() string {
+	return fmt.Sprintf("/v3/conversations/%s/activities", url.PathEscape(x.conversationID))
+}
+
+func cardActivity(card interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "message",
+		"attachments": []interface{}{
+			map[string]interface{}{
+				"contentType": adaptiveCardContentType,
+				"content":     card,
+			},
+		},
+	}
+}
+
+// PostCard posts the Adaptive Card to the conversation and returns ID of
+// the activity (message).
+func (x *Teams) PostCard(ctx context.Context, card interface{}) (string, error) {
+	var result struct {
+		ID string `json:"id"`
+	}
+	if err := x.request(ctx, "POST", x.activitiesPath(), cardActivity(card), &result); err != nil {
+		return "", errors.Wrap(err, "Fail to post a Teams card")
+	}
+	return result.ID, nil
+}
+
+// UpdateCard replaces the card of the activity.
+func (x *Teams) UpdateCard(ctx context.Context, activityID string, card interface{}) error {
+	activity := cardActivity(card)
+	activity["id"] = activityID
+
+	path := x.activitiesPath() + "/" + url.PathEscape(activityID)
+	if err := x.request(ctx, "PUT", path, activity, nil); err != nil {
+		return errors.Wrap(err, "Fail to update a Teams card")
+	}
+	return nil
+}
+
+const teamsSinkName = "teams"
+
+// TeamsSink posts a report to Microsoft Teams as an Adaptive Card. The card
+// is updated in place when the report gets a new alert and when it is
+// published.
+type TeamsSink struct {
+	teams *Teams
+
+	// SectionOrder sorts sections of published reports.
+	SectionOrder SectionOrder
+}
+
+// NewTeamsSink returns a sink for the Teams conversation.
+func NewTeamsSink(teams *Teams) *TeamsSink {
+	return &TeamsSink{teams: teams}
+}
+
+func (x *TeamsSink) Name() string { return teamsSinkName }
+
+func (x *TeamsSink) Create(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	id, err := x.teams.PostCard(ctx, BuildAdaptiveCard(report, cache.issueLink(), x.SectionOrder))
+	if err != nil {
+		return nil, errors.Wrap(err, "Fail to post a report to Teams")
+	}
+	cache.TeamsActivityID = id
+
+	return &SinkResult{Sink: x.Name(), Action: sinkCreate}, nil
+}
+
+// updateCard replaces the card of the report. If the report has no card yet
+// (e.g. Teams is configured later) or the card was deleted, it posts a new
+// one.
+func (x *TeamsSink) updateCard(ctx context.Context, report ar.Report, cache *ReportCache) error {
+	if cache.TeamsActivityID != "" {
+		err := x.teams.UpdateCard(ctx, cache.TeamsActivityID, BuildAdaptiveCard(report, cache.issueLink(), x.SectionOrder))
+		if err == nil {
+			return nil
+		}
+		if !IsTeamsNotFound(err) {
+			return errors.Wrap(err, "Fail to update a report in Teams")
+		}
+		log.WithField("activity", cache.TeamsActivityID).Warn("Teams card is not found, post a new one")
+	}
+
+	_, err := x.Create(ctx, report, cache)
+	return err
+}
+
+func (x *TeamsSink) Update(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	if err := x.updateCard(ctx, report, cache); err != nil {
+		return nil, err
+	}
+	return &SinkResult{Sink: x.Name(), Action: sinkUpdate}, nil
+}
+
+func (x *TeamsSink) Comment(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	if err := x.updateCard(ctx, report, cache); err != nil {
+		return nil, err
+	}
+	return &SinkResult{Sink: x.Name(), Action: sinkComment}, nil
+}
+
+// Resolve does nothing because Comment already updated the card with the
+// severity.
+func (x *TeamsSink) Resolve(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	return nil, nil
+}
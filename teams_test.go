@@ -0,0 +1,199 @@
+package main_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	main "github.com/m-mizutani/GithubEmitter"
+)
+
+type teamsCall struct {
+	method   string
+	path     string
+	activity map[string]interface{}
+}
+
+// fakeTeams is a stub of the token endpoint and Bot Framework Connector API
+// that records calls.
+type fakeTeams struct {
+	fakeServer
+	tokens int
+	calls  []teamsCall
+}
+
+func newFakeTeams() *fakeTeams {
+	x := &fakeTeams{}
+	x.start(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			r.ParseForm()
+			if r.Form.Get("client_secret") != "app-password" {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]string{
+					"error":             "invalid_client",
+					"error_description": "bad secret",
+				})
+				return
+			}
+			x.tokens++
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": "bot-token",
+				"expires_in":   3600,
+			})
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer bot-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var activity map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&activity)
+		x.calls = append(x.calls, teamsCall{method: r.Method, path: r.URL.Path, activity: activity})
+
+		if strings.HasSuffix(r.URL.Path, "/activities/deleted") {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"error": map[string]string{"code": "ActivityNotFound", "message": "not found"},
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id": fmt.Sprintf("activity-%d", len(x.calls))})
+	})
+	return x
+}
+
+func (x *fakeTeams) client(password string) *main.Teams {
+	return main.NewTeams("app-id", password, x.server.URL, "19:abc@thread.tacv2",
+		main.WithTeamsTokenURL(x.server.URL+"/token"))
+}
+
+func cardOf(t *testing.T, call teamsCall) string {
+	attachments, ok := call.activity["attachments"].([]interface{})
+	require.True(t, ok)
+	require.Equal(t, 1, len(attachments))
+	attachment := attachments[0].(map[string]interface{})
+	assert.Equal(t, "application/vnd.microsoft.card.adaptive", attachment["contentType"])
+
+	raw, err := json.Marshal(attachment["content"])
+	require.NoError(t, err)
+	return string(raw)
+}
+
+func TestTeamsSink(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeTeams()
+	defer fake.Close()
+
+	sink := main.NewTeamsSink(fake.client("app-password"))
+
+	report := genDummyReport()
+	cache := main.ReportCache{ReportID: report.ID, HtmlURL: "https://example.com/issues/1"}
+	_, err := sink.Create(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Equal(t, "activity-1", cache.TeamsActivityID)
+
+	report.Status = ar.StatusPublished
+	report.Result.Severity = ar.SevUrgent
+	res, err := sink.Comment(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Equal(t, "comment", res.Action)
+
+	require.Equal(t, 2, len(fake.calls))
+	assert.Equal(t, 1, fake.tokens)
+
+	post := fake.calls[0]
+	assert.Equal(t, "POST", post.method)
+	assert.Equal(t, "/v3/conversations/19:abc@thread.tacv2/activities", post.path)
+	card := cardOf(t, post)
+	assert.Contains(t, card, `"Severity: N/A"`)
+	assert.Contains(t, card, `"https://example.com/issues/1"`)
+	assert.Contains(t, card, `"title":"source address","value":"10.0.0.1 (remote)"`)
+
+	edit := fake.calls[1]
+	assert.Equal(t, "PUT", edit.method)
+	assert.Equal(t, "/v3/conversations/19:abc@thread.tacv2/activities/activity-1", edit.path)
+	assert.Equal(t, "activity-1", edit.activity["id"])
+	card = cardOf(t, edit)
+	assert.Contains(t, card, `"style":"attention"`)
+	assert.Contains(t, card, `"Severity: urgent"`)
+	assert.Contains(t, card, `"Action.ToggleVisibility"`)
+	assert.Contains(t, card, `"title":"Opponent Host: 10.0.0.1"`)
+	assert.Contains(t, card, `"isVisible":false`)
+	assert.Contains(t, card, "4490da766c35af92c8d8768136a5e775ed6a0929226ea9ab8995e50d5c516bf9")
+
+	res, err = sink.Resolve(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Nil(t, res)
+}
+
+func TestTeamsSinkDeletedCard(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeTeams()
+	defer fake.Close()
+
+	sink := main.NewTeamsSink(fake.client("app-password"))
+
+	report := genDummyReport()
+	cache := main.ReportCache{ReportID: report.ID, TeamsActivityID: "deleted"}
+	_, err := sink.Update(ctx, report, &cache)
+	require.NoError(t, err)
+
+	require.Equal(t, 2, len(fake.calls))
+	assert.Equal(t, "PUT", fake.calls[0].method)
+	assert.Equal(t, "POST", fake.calls[1].method)
+	assert.Equal(t, "activity-2", cache.TeamsActivityID)
+}
+
+func TestTeamsAPIError(t *testing.T) {
+	fake := newFakeTeams()
+	defer fake.Close()
+
+	_, err := fake.client("bad-password").PostCard(context.Background(), map[string]string{})
+	require.Error(t, err)
+	apiErr, ok := errors.Cause(err).(*main.TeamsAPIError)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+	assert.Equal(t, "invalid_client", apiErr.Code)
+	assert.Equal(t, 0, len(fake.calls))
+}
+
+func TestAdaptiveCardEscape(t *testing.T) {
+	report := genDummyReport()
+	report.Status = ar.StatusPublished
+	report.Result.Severity = ar.SevUrgent
+	report.Result.Reason = "see [here](https://evil.example.com) @admin"
+	report.Alert.Rule = "**rule** <b>"
+	report.Alert.Attrs[0].Key = "_key_"
+	report.Alert.Attrs[0].Value = "[x](https://evil.example.com)"
+	page := report.Content.OpponentHosts["10.0.0.1"]
+	page.RelatedURLs = []ar.ReportURL{
+		{URL: "http://evil.example.com/*x*", Source: "vt", Reference: "javascript:alert(1)"},
+		{URL: "http://ok.example.com", Source: "vt", Reference: "https://ref.example.com/a b(c)"},
+	}
+	report.Content.OpponentHosts["10.0.0.1"] = page
+
+	raw, err := json.Marshal(main.BuildAdaptiveCard(report, "javascript:alert(1)", main.SectionOrder{}))
+	require.NoError(t, err)
+	card := string(raw)
+
+	z := zeroWidthSpace
+	assert.Contains(t, card, `"Reason: see [here]`+z+`(https://evil.example.com) @admin"`)
+	assert.Contains(t, card, `"title":"Rule","value":"`+z+`*`+z+z+`*`+z+`rule`+z+`*`+z+z+`*`+z+` \u003cb\u003e"`)
+	assert.Contains(t, card, `"title":"`+z+`_`+z+`key`+z+`_`+z+`","value":"[x]`+z+`(https://evil.example.com) (remote)"`)
+	assert.Contains(t, card, `"title":"http://evil.example.com/`+z+`*`+z+`x`+z+`*`+z+`"`)
+	assert.NotContains(t, card, `\\`)
+	assert.Contains(t, card, `(vt) (Ref: javascript:alert(1))"`)
+	assert.Contains(t, card, ` [Ref](https://ref.example.com/a%20b%28c%29)"`)
+	// The issue is not linked by an unsafe URL.
+	assert.NotContains(t, card, `"Action.OpenUrl"`)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// WebhookSignatureHeader has HMAC-SHA256 of the request body by the
+	// secret as "sha256=<hex>".
+	WebhookSignatureHeader = "X-GheReporter-Signature"
+	// WebhookEventHeader has the event of the envelope.
+	WebhookEventHeader = "X-GheReporter-Event"
+
+	webhookVersion         = 1
+	defaultWebhookTimeout  = 30 * time.Second
+	defaultWebhookMaxRetry = 2 * time.Minute
+)
+
+// Events of webhook envelope.
+const (
+	WebhookCreated   = "created"
+	WebhookUpdated   = "updated"
+	WebhookPublished = "published"
+	WebhookClosed    = "closed"
+)
+
+// WebhookEnvelope is a JSON body of a webhook request. Fields are kept
+// stable for consumers, and a change that breaks them bumps Version.
+// IssueTracker ("github", "gitlab" or "jira") owns the issue, and both
+// IssueAPIURL and IssueHTMLURL are of that issue. IssueAPIURL is set only
+// for GitHub.
+type WebhookEnvelope struct {
+	Version      int       `json:"version"`
+	Event        string    `json:"event"`
+	Timestamp    time.Time `json:"timestamp"`
+	ReportID     string    `json:"report_id"`
+	Title        string    `json:"title"`
+	Rule         string    `json:"rule"`
+	Status       string    `json:"status"`
+	Severity     string    `json:"severity"`
+	IssueTracker string    `json:"issue_tracker,omitempty"`
+	IssueAPIURL  string    `json:"issue_api_url,omitempty"`
+	IssueHTMLURL string    `json:"issue_html_url,omitempty"`
+	Markdown     string    `json:"markdown"`
+}
+
+// NewWebhookEnvelope returns an envelope of the report event. Markdown is
+// the issue body for created and updated events, and the published report
+// with sections sorted by the order for published and closed events.
+func NewWebhookEnvelope(event string, report ar.Report, cache *ReportCache, order SectionOrder, now time.Time) WebhookEnvelope {
+	markdown := BuildIssueBody(report)
+	if event == WebhookPublished || event == WebhookClosed {
+		markdown = BuildPublishedReportHeader(report) + BuildCommentBody(report, order)
+	}
+
+	tracker, apiURL, htmlURL := cache.issue()
+	return WebhookEnvelope{
+		Version:      webhookVersion,
+		Event:        event,
+		Timestamp:    now.UTC(),
+		ReportID:     string(report.ID),
+		Title:        report.Alert.Title(),
+		Rule:         report.Alert.Rule,
+		Status:       string(report.Status),
+		Severity:     string(report.Result.Severity),
+		IssueTracker: tracker,
+		IssueAPIURL:  apiURL,
+		IssueHTMLURL: htmlURL,
+		Markdown:     markdown,
+	}
+}
+
+// SignWebhookPayload returns a value of WebhookSignatureHeader for the body.
+// A receiver computes it with the shared secret and compares by
+// hmac.Equal.
+func SignWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookError is an error response of a webhook endpoint.
+type WebhookError struct {
+	StatusCode int
+	Body       string
+}
+
+func (x *WebhookError) Error() string {
+	return fmt.Sprintf("Webhook error (%d): %s", x.StatusCode, x.Body)
+}
+
+// Retryable returns true if the endpoint may accept the request later.
+func (x *WebhookError) Retryable() bool {
+	return x.StatusCode == http.StatusTooManyRequests || x.StatusCode >= 500
+}
+
+// Webhook sends signed envelopes to an endpoint.
+type Webhook struct {
+	url          string
+	secret       string
+	maxRetryTime time.Duration
+	client       *http.Client
+}
+
+// WebhookOption is an optional setting of Webhook.
+type WebhookOption func(x *Webhook)
+
+// WithWebhookMaxRetryTime sets time limit of retries. Zero disables retry.
+func WithWebhookMaxRetryTime(d time.Duration) WebhookOption {
+	return func(x *Webhook) {
+		x.maxRetryTime = d
+	}
+}
+
+// NewWebhook returns a Webhook for the endpoint URL. Requests are signed by
+// the secret.
+func NewWebhook(url, secret string, options ...WebhookOption) *Webhook {
+	x := &Webhook{
+		url:          url,
+		secret:       secret,
+		maxRetryTime: defaultWebhookMaxRetry,
+		client:       &http.Client{Timeout: defaultWebhookTimeout},
+	}
+	for _, opt := range options {
+		opt(x)
+	}
+	return x
+}
+
+// Send posts the envelope. It's retried with exponential backoff on network
+// errors, 429 and 5xx responses.
+func (x *Webhook) Send(ctx context.Context, envelope WebhookEnvelope) error {
+	body, err := json.Marshal(envelope)
+	if err != nil {
+		return errors.Wrap(err, "Fail to marshal webhook envelope")
+	}
+	signature := SignWebhookPayload(x.secret, body)
+
+	operation := func() error {
+		req, err := http.NewRequest("POST", x.url, bytes.NewReader(body))
+		if err != nil {
+			return backoff.Permanent(errors.Wrap(err, "Fail to create webhook request"))
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(WebhookEventHeader, envelope.Event)
+		req.Header.Set(WebhookSignatureHeader, signature)
+
+		resp, err := x.client.Do(req)
+		if ctx.Err() != nil {
+			return backoff.Permanent(ctx.Err())
+		} else if err != nil {
+			return errors.Wrapf(err, "Fail to send webhook request to %s", x.url)
+		}
+		defer resp.Body.Close()
+
+		if 200 <= resp.StatusCode && resp.StatusCode < 300 {
+			io.Copy(ioutil.Discard, resp.Body)
+			return nil
+		}
+
+		raw, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		whErr := &WebhookError{StatusCode: resp.StatusCode, Body: string(raw)}
+		if !whErr.Retryable() {
+			return backoff.Permanent(whErr)
+		}
+		return whErr
+	}
+
+	var b backoff.BackOff = &backoff.StopBackOff{}
+	if x.maxRetryTime > 0 {
+		eb := backoff.NewExponentialBackOff()
+		eb.MaxElapsedTime = x.maxRetryTime
+		b = eb
+	}
+
+	notify := func(err error, wait time.Duration) {
+		log.WithError(err).WithField("wait", wait).Warn("Retry webhook request")
+	}
+
+	return backoff.RetryNotify(operation, backoff.WithContext(b, ctx), notify)
+}
+
+const webhookSinkName = "webhook"
+
+// WebhookSink posts an envelope of each report event to a webhook endpoint.
+// Place it after issue tracker sinks to carry URL of the issue.
+type WebhookSink struct {
+	webhook *Webhook
+
+	// SectionOrder sorts sections of published reports.
+	SectionOrder SectionOrder
+}
+
+// NewWebhookSink returns a sink for the webhook.
+func NewWebhookSink(webhook *Webhook) *WebhookSink {
+	return &WebhookSink{webhook: webhook}
+}
+
+func (x *WebhookSink) Name() string { return webhookSinkName }
+
+func (x *WebhookSink) send(ctx context.Context, event, action string, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	envelope := NewWebhookEnvelope(event, report, cache, x.SectionOrder, time.Now())
+	if err := x.webhook.Send(ctx, envelope); err != nil {
+		return nil, errors.Wrapf(err, "Fail to send %s event by webhook", event)
+	}
+	return &SinkResult{Sink: x.Name(), Action: action}, nil
+}
+
+func (x *WebhookSink) Create(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	return x.send(ctx, WebhookCreated, sinkCreate, report, cache)
+}
+
+func (x *WebhookSink) Update(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	return x.send(ctx, WebhookUpdated, sinkUpdate, report, cache)
+}
+
+func (x *WebhookSink) Comment(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	return x.send(ctx, WebhookPublished, sinkComment, report, cache)
+}
+
+func (x *WebhookSink) Resolve(ctx context.Context, report ar.Report, cache *ReportCache) (*SinkResult, error) {
+	return x.send(ctx, WebhookClosed, sinkResolve, report, cache)
+}
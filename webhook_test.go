@@ -0,0 +1,158 @@
+package main_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	ar "github.com/m-mizutani/AlertResponder/lib"
+	main "github.com/m-mizutani/GithubEmitter"
+)
+
+// fakeWebhook is a webhook endpoint that verifies signatures and records
+// envelopes. It responds statuses in order and 200 after them.
+type fakeWebhook struct {
+	fakeServer
+	statuses  []int
+	requests  int
+	envelopes []main.WebhookEnvelope
+}
+
+func newFakeWebhook(t *testing.T, secret string, statuses ...int) *fakeWebhook {
+	x := &fakeWebhook{statuses: statuses}
+	x.start(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+
+		expected := main.SignWebhookPayload(secret, body)
+		if !hmac.Equal([]byte(expected), []byte(r.Header.Get(main.WebhookSignatureHeader))) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		x.requests++
+		if len(x.statuses) > 0 {
+			status := x.statuses[0]
+			x.statuses = x.statuses[1:]
+			w.WriteHeader(status)
+			return
+		}
+
+		var envelope main.WebhookEnvelope
+		require.NoError(t, json.Unmarshal(body, &envelope))
+		assert.Equal(t, envelope.Event, r.Header.Get(main.WebhookEventHeader))
+		x.envelopes = append(x.envelopes, envelope)
+	})
+	return x
+}
+
+func TestWebhookSink(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeWebhook(t, "s3cr3t")
+	defer fake.Close()
+
+	sink := main.NewWebhookSink(main.NewWebhook(fake.server.URL, "s3cr3t"))
+
+	report := genDummyReport()
+	cache := main.ReportCache{
+		ReportID: report.ID,
+		IssueURL: "https://api.example.com/repos/blue/five/issues/1",
+		HtmlURL:  "https://example.com/blue/five/issues/1",
+	}
+	_, err := sink.Create(ctx, report, &cache)
+	require.NoError(t, err)
+	_, err = sink.Update(ctx, report, &cache)
+	require.NoError(t, err)
+
+	report.Status = ar.StatusPublished
+	report.Result.Severity = ar.SevSafe
+	res, err := sink.Comment(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Equal(t, "comment", res.Action)
+	res, err = sink.Resolve(ctx, report, &cache)
+	require.NoError(t, err)
+	assert.Equal(t, "resolve", res.Action)
+
+	require.Equal(t, 4, len(fake.envelopes))
+	events := []string{}
+	for _, envelope := range fake.envelopes {
+		events = append(events, envelope.Event)
+		assert.Equal(t, 1, envelope.Version)
+		assert.Equal(t, string(report.ID), envelope.ReportID)
+		assert.Equal(t, "github", envelope.IssueTracker)
+		assert.Equal(t, cache.IssueURL, envelope.IssueAPIURL)
+		assert.Equal(t, cache.HtmlURL, envelope.IssueHTMLURL)
+	}
+	assert.Equal(t, []string{"created", "updated", "published", "closed"}, events)
+
+	assert.Equal(t, "", fake.envelopes[0].Severity)
+	assert.Contains(t, fake.envelopes[0].Markdown, "## Overview")
+	assert.Equal(t, "safe", fake.envelopes[2].Severity)
+	assert.Contains(t, fake.envelopes[2].Markdown, "## Opponent Host: 10.0.0.1")
+}
+
+func TestWebhookEnvelopeIssue(t *testing.T) {
+	report := genDummyReport()
+	now := time.Now()
+
+	// URLs are of the same issue even if GitHub has no HTML URL.
+	cache := main.ReportCache{
+		ReportID:  report.ID,
+		IssueURL:  "https://api.example.com/repos/blue/five/issues/1",
+		GitLabURL: "https://gitlab.example.com/blue/five/-/issues/1",
+		JiraURL:   "https://jira.example.com/browse/SEC-1",
+	}
+	envelope := main.NewWebhookEnvelope(main.WebhookCreated, report, &cache, main.SectionOrder{}, now)
+	assert.Equal(t, "gitlab", envelope.IssueTracker)
+	assert.Equal(t, "", envelope.IssueAPIURL)
+	assert.Equal(t, cache.GitLabURL, envelope.IssueHTMLURL)
+
+	cache = main.ReportCache{ReportID: report.ID, JiraURL: "https://jira.example.com/browse/SEC-1"}
+	envelope = main.NewWebhookEnvelope(main.WebhookCreated, report, &cache, main.SectionOrder{}, now)
+	assert.Equal(t, "jira", envelope.IssueTracker)
+	assert.Equal(t, cache.JiraURL, envelope.IssueHTMLURL)
+
+	cache = main.ReportCache{ReportID: report.ID}
+	envelope = main.NewWebhookEnvelope(main.WebhookCreated, report, &cache, main.SectionOrder{}, now)
+	assert.Equal(t, "", envelope.IssueTracker)
+	assert.Equal(t, "", envelope.IssueHTMLURL)
+}
+
+func TestWebhookRetry(t *testing.T) {
+	fake := newFakeWebhook(t, "s3cr3t", http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	defer fake.Close()
+
+	webhook := main.NewWebhook(fake.server.URL, "s3cr3t", main.WithWebhookMaxRetryTime(10*time.Second))
+	envelope := main.NewWebhookEnvelope(main.WebhookCreated, genDummyReport(), &main.ReportCache{}, main.SectionOrder{}, time.Now())
+	require.NoError(t, webhook.Send(context.Background(), envelope))
+	assert.Equal(t, 3, fake.requests)
+	assert.Equal(t, 1, len(fake.envelopes))
+}
+
+func TestWebhookError(t *testing.T) {
+	fake := newFakeWebhook(t, "s3cr3t", http.StatusBadRequest)
+	defer fake.Close()
+
+	webhook := main.NewWebhook(fake.server.URL, "s3cr3t")
+	envelope := main.NewWebhookEnvelope(main.WebhookCreated, genDummyReport(), &main.ReportCache{}, main.SectionOrder{}, time.Now())
+	err := webhook.Send(context.Background(), envelope)
+	require.Error(t, err)
+	whErr, ok := errors.Cause(err).(*main.WebhookError)
+	require.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, whErr.StatusCode)
+	assert.Equal(t, 1, fake.requests)
+
+	// A wrong secret is rejected by the receiver and not retried.
+	webhook = main.NewWebhook(fake.server.URL, "wrong", main.WithWebhookMaxRetryTime(0))
+	err = webhook.Send(context.Background(), envelope)
+	require.Error(t, err)
+	assert.Equal(t, 1, fake.requests)
+}